@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	ManifestFileName = "manifest.json"
+	backupTimeout    = time.Minute // how long a backup waits for running txs
+)
+
+// backup type
+const (
+	FullBackup        = "full"
+	IncrementalBackup = "incremental"
+)
+
+var (
+	errBackupExists = errors.New("backup already exists")
+	errWalMissing   = errors.New("wal records are missing")
+)
+
+// BackupManifest describes a backup. It is written last, so a directory
+// without it is an incomplete backup.
+//
+// A full backup is a db-file and the wal from StartLSN to EndLSN. An
+// incremental backup only has the wal since its parent, which is the previous
+// backup of the chain.
+type BackupManifest struct {
+	Type     string       `json:"type"`
+	Parent   string       `json:"parent,omitempty"` // relative to the backup dir
+	Ts       uint64       `json:"ts,omitempty"`     // db-file contains every tx whose ts is not larger
+	LSN      uint64       `json:"lsn,omitempty"`    // lsn of db-file
+	StartLSN uint64       `json:"start_lsn"`        // the wal starts here
+	EndLSN   uint64       `json:"end_lsn"`          // and ends here
+	Created  time.Time    `json:"created"`
+	Files    []BackupFile `json:"files"`
+}
+
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	CRC32C uint32 `json:"crc32c"`
+}
+
+// Backup writes a consistent copy of the running DB to dir: a db-file at a
+// new ts and the wal records committed while it was written. Starting a DB
+// with the files in dir recovers the DB as of the end of the backup.
+//
+// Txs keep running during the backup, only checkpoints wait for it.
+func (db *DB) Backup(dir string) (*BackupManifest, error) {
+	if err := createBackupDir(db.fs, dir); err != nil {
+		return nil, err
+	}
+
+	// checkpoint に wal segment を消させない
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+
+	tx, lsn, err := db.snapshotTx(backupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.DestructTx()
+	manifest := &BackupManifest{
+		Type:     FullBackup,
+		Ts:       tx.ts,
+		LSN:      lsn,
+		StartLSN: lsn + 1,
+		Created:  time.Now(),
+	}
+
+	// db-memory -> backup db-file
+	dbFileName := filepath.Base(db.dbFileName)
+	if err := writeFile(db.fs, filepath.Join(dir, dbFileName), func(w io.Writer) error {
+		return db.writeSnapshot(w, tx.ts, lsn)
+	}); err != nil {
+		return nil, err
+	}
+	files := []string{dbFileName}
+
+	// db-file を書いている間に commit された tx の wal
+	if err := db.backupWal(dir, manifest, files); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// BackupIncremental writes the wal records committed since the backup in
+// parent to dir. The wal since then has to be kept, in the current wal or in
+// the archive dir.
+func (db *DB) BackupIncremental(dir, parent string) (*BackupManifest, error) {
+	prev, err := readManifest(db.fs, parent)
+	if err != nil {
+		return nil, err
+	}
+	if err := createBackupDir(db.fs, dir); err != nil {
+		return nil, err
+	}
+	rel, err := relPath(dir, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+
+	manifest := &BackupManifest{
+		Type:     IncrementalBackup,
+		Parent:   rel,
+		StartLSN: prev.EndLSN + 1,
+		Created:  time.Now(),
+	}
+	if err := db.backupWal(dir, manifest, nil); err != nil {
+		if errors.Is(err, errWalMissing) {
+			return nil, fmt.Errorf("%w since lsn %v, take a full backup", err, manifest.StartLSN)
+		}
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// backupWal copies the durable wal records since manifest.StartLSN to dir and
+// writes the manifest of files and the wal. checkpointMu must be held.
+func (db *DB) backupWal(dir string, manifest *BackupManifest, files []string) error {
+	// fsync していない record は crash で消えうるので backup に入れない
+	if err := db.wal.sync(); err != nil {
+		return err
+	}
+	manifest.EndLSN = db.wal.durable()
+	if manifest.EndLSN < manifest.StartLSN {
+		manifest.EndLSN = manifest.StartLSN - 1 // 新しい wal は無い
+	}
+	if manifest.EndLSN >= manifest.StartLSN {
+		segments := db.wal.log.list()
+		if db.opts.ArchiveDir != "" {
+			var err error
+			if segments, err = restoreSegments(db.fs, db.wal.log.prefix, db.opts.ArchiveDir); err != nil {
+				return err
+			}
+		}
+		walFileName := segmentPath(filepath.Base(db.wal.log.prefix), manifest.StartLSN)
+		if err := writeFile(db.fs, filepath.Join(dir, walFileName), func(w io.Writer) error {
+			return copyWal(db.fs, w, segments, manifest.StartLSN, manifest.EndLSN, db.wal.log.format, db.opts.Keys)
+		}); err != nil {
+			return err
+		}
+		files = append(files, walFileName)
+	}
+
+	for _, name := range files {
+		file, err := checksumFile(db.fs, dir, name)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, *file)
+	}
+	return writeManifest(db.fs, dir, manifest)
+}
+
+// copyWal writes a segment containing the wal records from lsn from to to.
+// The records are stored in dst, the segments are read with keys.
+func copyWal(fs FileSystem, w io.Writer, segments []segment, from, to uint64, dst walFormat, keys *Keyring) error {
+	if _, err := w.Write(newSegmentHeader(dst)); err != nil {
+		return err
+	}
+	next := from
+	for i, seg := range segments {
+		if i+1 < len(segments) && segments[i+1].firstLSN <= from {
+			continue
+		}
+		file, format, err := openSegment(fs, seg.path, keys)
+		if err != nil {
+			return err
+		}
+		reader, err := newWALReader(file, format)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		for next <= to {
+			buf, err := reader.nextRaw()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return err
+			}
+			plain, err := format.unpack(buf)
+			if err != nil {
+				file.Close()
+				return err
+			}
+			rec, err := decodeRecord(plain)
+			if err != nil {
+				file.Close()
+				return err
+			}
+			if rec.lsn < next {
+				continue
+			}
+			if rec.lsn != next {
+				file.Close()
+				return errWalMissing
+			}
+			// 鍵や codec が変わっていれば今の format で書き直す
+			if format != dst {
+				buf = dst.pack(plain)
+			}
+			if _, err := w.Write(buf); err != nil {
+				file.Close()
+				return err
+			}
+			next++
+		}
+		file.Close()
+		if next > to {
+			return nil
+		}
+	}
+	return errWalMissing
+}
+
+func createBackupDir(fs FileSystem, dir string) error {
+	if _, err := fs.Stat(filepath.Join(dir, ManifestFileName)); err == nil {
+		return errBackupExists
+	}
+	return fs.MkdirAll(dir, 0777)
+}
+
+// relPath returns path relative to dir if possible.
+func relPath(dir, path string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(absDir, absPath); err == nil {
+		return rel, nil
+	}
+	return absPath, nil
+}
+
+// writeFile creates path, writes it by write and makes it durable.
+func writeFile(fs FileSystem, path string, write func(w io.Writer) error) error {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if err := write(w); err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func checksumFile(fs FileSystem, dir, name string) (*BackupFile, error) {
+	file, err := openFile(fs, filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := crc32.New(crc32c)
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupFile{Name: name, Size: size, CRC32C: hash.Sum32()}, nil
+}
+
+func writeManifest(fs FileSystem, dir string, manifest *BackupManifest) error {
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFileName := filepath.Join(dir, ManifestFileName+".tmp")
+	fs.Remove(tmpFileName)
+	if err := writeFile(fs, tmpFileName, func(w io.Writer) error {
+		_, err := w.Write(append(buf, '\n'))
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmpFileName, filepath.Join(dir, ManifestFileName)); err != nil {
+		return err
+	}
+	return fs.SyncDir(dir)
+}
+
+func readManifest(fs FileSystem, dir string) (*BackupManifest, error) {
+	buf, err := readFile(fs, filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(buf, manifest); err != nil {
+		return nil, fmt.Errorf("%v: broken manifest: %w", dir, err)
+	}
+	return manifest, nil
+}
+
+// backupChain returns the dirs and manifests from the full backup to the one
+// in dir, checking that each backup follows its parent.
+func backupChain(fs FileSystem, dir string) ([]string, []*BackupManifest, error) {
+	var dirs []string
+	var manifests []*BackupManifest
+	for {
+		manifest, err := readManifest(fs, dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		dirs = append([]string{dir}, dirs...)
+		manifests = append([]*BackupManifest{manifest}, manifests...)
+		if manifest.Type == FullBackup {
+			break
+		}
+		if manifest.Type != IncrementalBackup || manifest.Parent == "" {
+			return nil, nil, fmt.Errorf("%v: unknown backup type %q", dir, manifest.Type)
+		}
+		parent := manifest.Parent
+		if !filepath.IsAbs(parent) {
+			parent = filepath.Join(dir, parent)
+		}
+		dir = parent
+	}
+	for i := 1; i < len(manifests); i++ {
+		if manifests[i].StartLSN != manifests[i-1].EndLSN+1 {
+			return nil, nil, fmt.Errorf("%v does not follow %v: wal from lsn %v is expected, but it starts at %v",
+				dirs[i], dirs[i-1], manifests[i-1].EndLSN+1, manifests[i].StartLSN)
+		}
+	}
+	return dirs, manifests, nil
+}
+
+// verifyBackup checks the size and the checksum of every file of a backup.
+func verifyBackup(fs FileSystem, dir string, manifest *BackupManifest) error {
+	for _, want := range manifest.Files {
+		got, err := checksumFile(fs, dir, want.Name)
+		if err != nil {
+			return err
+		}
+		if *got != want {
+			return fmt.Errorf("%v: checksum mismatch (size %v, crc32c %08x, expected size %v, crc32c %08x)",
+				filepath.Join(dir, want.Name), got.Size, got.CRC32C, want.Size, want.CRC32C)
+		}
+	}
+	return nil
+}
+
+// RestoreBackup writes db-file to outFileName from the backup in dir, applying
+// its full backup and then every incremental backup of the chain in order (up
+// to target if it is not nil). Every file is verified before it is used.
+// opts.Keys has to have the keys the backup is encrypted with.
+func RestoreBackup(dir, walFileName, outFileName string, opts Options, target *RecoveryTarget) (*RecoveryReport, error) {
+	fs := opts.fileSystem()
+	dirs, manifests, err := backupChain(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, dir := range dirs {
+		if err := verifyBackup(fs, dir, manifests[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	opts.ArchiveDir = "" // restore の結果は archive しない
+	db := NewDB(walFileName, outFileName, opts)
+	defer db.close()
+	db.target = target
+
+	// full backup の db-file
+	base := manifests[0]
+	if len(base.Files) == 0 {
+		return nil, fmt.Errorf("%v: db-file is missing", dirs[0])
+	}
+	file, err := openFile(fs, filepath.Join(dirs[0], base.Files[0].Name))
+	if err != nil {
+		return nil, err
+	}
+	err = db.loadSnapshot(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", dirs[0], err)
+	}
+	if !target.includes(0, db.checkpointTs) {
+		return nil, fmt.Errorf("%v is after the target", dirs[0])
+	}
+
+	// 各 backup の wal を順に replay する
+	var segments []segment
+	for i, manifest := range manifests {
+		for _, file := range manifest.Files {
+			if lsn, ok := segmentLSN(file.Name); ok && lsn == manifest.StartLSN {
+				segments = append(segments, segment{path: filepath.Join(dirs[i], file.Name), firstLSN: lsn})
+			}
+		}
+	}
+	if err := checkSegmentKeys(fs, segments, opts.Keys); err != nil {
+		return nil, err
+	}
+	report := db.replayWal(segments)
+	if report.SnapshotAfterTarget {
+		return nil, fmt.Errorf("%v is after the target", dirs[0])
+	}
+	lsn := db.checkpointLSN
+	if report.LastLSN > lsn {
+		lsn = report.LastLSN
+	}
+	if last := manifests[len(manifests)-1].EndLSN; report.MissingFrom > 0 || lsn < last {
+		return nil, fmt.Errorf("wal of the backup is incomplete: %v", report)
+	}
+
+	ts := db.checkpointTs
+	if report.LastTs > ts {
+		ts = report.LastTs
+	}
+	if err := db.saveData(ts, lsn); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDB_Backup(t *testing.T) {
+	dir := t.TempDir()
+	db := newTempDB(t, Options{SegmentSize: 1024})
+	db.Setup()
+
+	// backup 中も tx は動き続ける
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key%v-%v", i, n%10)
+				value := fmt.Sprintf("value%v", n)
+				tx := NewTx(db)
+				if n < 10 {
+					tx.Insert(key, value)
+				} else {
+					tx.Update(key, value)
+				}
+				tx.Commit()
+				tx.DestructTx()
+			}
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := db.checkpoint(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	backupDir := filepath.Join(dir, "backup")
+	manifest, err := db.Backup(backupDir)
+	if err != nil {
+		t.Fatalf("failed to backup: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+	if _, err := db.Backup(backupDir); err != errBackupExists {
+		t.Errorf("should not overwrite a backup: %v", err)
+	}
+
+	for _, file := range manifest.Files {
+		checksum, err := checksumFile(osFS{}, backupDir, file.Name)
+		if err != nil || *checksum != file {
+			t.Errorf("wrong checksum of %v", file.Name)
+		}
+	}
+
+	// backup から起動すると backup の終わりの状態になる
+	restored := NewDB(filepath.Join(backupDir, "seccampdb.log"), filepath.Join(backupDir, "seccampdb.db"), Options{})
+	defer restored.close()
+	if err := restored.loadData(); err != nil {
+		t.Fatal(err)
+	}
+	report := restored.loadWal()
+	if report.LastLSN != manifest.EndLSN || len(report.Dropped) > 0 {
+		t.Errorf("wrong wal tail: %v", report)
+	}
+	db.index.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		version := v.(*Record).versionAt(manifest.Ts)
+		r, exist := restored.index.Load(key)
+		if version == nil {
+			return true
+		}
+		if !exist {
+			t.Errorf("%v is not in the backup", key)
+			return true
+		}
+		if backup := r.(*Record).last; backup.wTs < version.wTs {
+			t.Errorf("%v in the backup is older than the snapshot: %v < %v", key, backup.wTs, version.wTs)
+		}
+		return true
+	})
+}
+
+func TestDB_Backup_NoSync(t *testing.T) {
+	dir := t.TempDir()
+	db := newTempDB(t, Options{Durability: NoSync})
+	db.Setup()
+
+	tx := NewTx(db)
+	tx.Insert("key", "value")
+	lsn, err := tx.Commit()
+	tx.DestructTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fsync していない record も fsync してから backup に入れる
+	manifest, err := db.Backup(filepath.Join(dir, "backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.EndLSN != lsn || db.DurableLSN() < lsn {
+		t.Errorf("end lsn %v, durable lsn %v, want %v", manifest.EndLSN, db.DurableLSN(), lsn)
+	}
+}
+
+func TestDB_BackupIncremental(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{SegmentSize: 256, ArchiveDir: filepath.Join(dir, "archive")}
+	db := newTempDB(t, opts)
+	db.Setup()
+	write := func(key, value string) {
+		tx := NewTx(db)
+		defer tx.DestructTx()
+		if _, exist := db.index.Load(key); exist {
+			tx.Update(key, value)
+		} else {
+			tx.Insert(key, value)
+		}
+		if _, err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("key1", "value1")
+	full := filepath.Join(dir, "backup", "full")
+	if _, err := db.Backup(full); err != nil {
+		t.Fatal(err)
+	}
+	write("key2", "value2")
+	// 間の checkpoint で消された wal は archive から読む
+	if err := db.checkpoint(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	incr1 := filepath.Join(dir, "backup", "incr1")
+	if _, err := db.BackupIncremental(incr1, full); err != nil {
+		t.Fatalf("failed to backup: %v", err)
+	}
+	incr2 := filepath.Join(dir, "backup", "incr2")
+	if _, err := db.BackupIncremental(incr2, incr1); err != nil { // 新しい wal は無い
+		t.Fatalf("failed to backup: %v", err)
+	}
+	write("key1", "value11")
+	write("key3", "value3")
+	incr3 := filepath.Join(dir, "backup", "incr3")
+	manifest, err := db.BackupIncremental(incr3, incr2)
+	if err != nil {
+		t.Fatalf("failed to backup: %v", err)
+	}
+	if manifest.Type != IncrementalBackup || manifest.Parent != filepath.Join("..", "incr2") {
+		t.Errorf("wrong manifest: %v", manifest)
+	}
+	write("key4", "value4")
+
+	tests := []struct {
+		dir  string
+		want map[string]string
+	}{
+		{full, map[string]string{"key1": "value1"}},
+		{incr2, map[string]string{"key1": "value1", "key2": "value2"}},
+		{incr3, map[string]string{"key1": "value11", "key2": "value2", "key3": "value3"}},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(t.TempDir(), "seccampdb.db")
+		if _, err := RestoreBackup(tt.dir, filepath.Join(filepath.Dir(out), "seccampdb.log"), out, Options{}, nil); err != nil {
+			t.Fatalf("failed to restore %v: %v", tt.dir, err)
+		}
+		restored := NewDB(filepath.Join(filepath.Dir(out), "seccampdb.log"), out, Options{})
+		if err := restored.loadData(); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		restored.index.Range(func(k, v interface{}) bool {
+			if tt.want[k.(string)] != v.(*Record).last.value {
+				t.Errorf("wrong value of %v in %v", k, tt.dir)
+			}
+			n++
+			return true
+		})
+		if n != len(tt.want) {
+			t.Errorf("wrong number of keys in %v: %v", tt.dir, n)
+		}
+		restored.close()
+	}
+
+	// 壊れた backup からは restore しない
+	incr, err := readManifest(osFS{}, incr1)
+	if err != nil || len(incr.Files) != 1 {
+		t.Fatalf("wrong manifest: %v", err)
+	}
+	walFile := filepath.Join(incr1, incr.Files[0].Name)
+	buf, err := ioutil.ReadFile(walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-1] ^= 0xff
+	if err := ioutil.WriteFile(walFile, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "seccampdb.db")
+	if _, err := RestoreBackup(incr3, filepath.Join(filepath.Dir(out), "seccampdb.log"), out, Options{}, nil); err == nil {
+		t.Error("should fail with a checksum mismatch")
+	}
+}
+
+func TestDB_BackupIncremental_WalMissing(t *testing.T) {
+	dir := t.TempDir()
+	db := newTempDB(t, Options{})
+	db.Setup()
+
+	full := filepath.Join(dir, "full")
+	if _, err := db.Backup(full); err != nil {
+		t.Fatal(err)
+	}
+	tx := NewTx(db)
+	tx.Insert("key1", "value1")
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.DestructTx()
+	if err := db.checkpoint(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.BackupIncremental(filepath.Join(dir, "incr"), full); !errors.Is(err, errWalMissing) {
+		t.Errorf("should fail without the wal: %v", err)
+	}
+}
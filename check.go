@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CheckReport is the result of an offline check of db-file and the wal.
+type CheckReport struct {
+	Problems []string // corruption
+	Warnings []string // recoverable, e.g. a torn tail left by a crash
+
+	// db-file
+	Keys   int
+	Blocks uint32
+	LSN    uint64
+	Ts     uint64
+
+	// what Setup would do
+	Refused  error           // Setup would refuse to start
+	Recovery *RecoveryReport // nil if refused
+}
+
+func (r *CheckReport) problem(format string, a ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, a...))
+}
+
+func (r *CheckReport) warning(format string, a ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, a...))
+}
+
+func (r *CheckReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "db-file: %v key(s) in %v block(s), lsn %v, ts %v\n", r.Keys, r.Blocks, r.LSN, r.Ts)
+	for _, p := range r.Problems {
+		fmt.Fprintf(&b, "error: %v\n", p)
+	}
+	for _, w := range r.Warnings {
+		fmt.Fprintf(&b, "warning: %v\n", w)
+	}
+	if r.Refused != nil {
+		fmt.Fprintf(&b, "setup would refuse to start: %v\n", r.Refused)
+	} else {
+		fmt.Fprintf(&b, "setup would load %v key(s) from db-file and %v\n", r.Keys, r.Recovery)
+	}
+	if len(r.Problems) == 0 {
+		b.WriteString("ok\n")
+	}
+	return b.String()
+}
+
+// Check validates db-file and the wal without modifying them: every checksum,
+// record boundary and lsn, duplicate keys and torn tails. It also reports what
+// Setup would recover with opts.
+func Check(walFileName, dbFileName string, opts Options) (*CheckReport, error) {
+	fs := opts.fileSystem()
+	report := &CheckReport{}
+	if err := checkSnapshot(fs, dbFileName, opts.Keys, report); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(fs, walFileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSegmentKeys(fs, segments, opts.Keys); err != nil {
+		return nil, err
+	}
+	if err := checkWal(fs, segments, opts.Keys, report); err != nil {
+		return nil, err
+	}
+
+	// Setup と同じ手順で db-memory に読み込む (file は変更しない)
+	db := &DB{opts: opts, fs: fs}
+	if file, err := openFile(fs, dbFileName); err == nil {
+		err = db.loadSnapshot(file)
+		file.Close()
+		if err != nil {
+			report.Refused = err
+			return report, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	report.Recovery = db.replayWal(segments)
+	if report.Recovery.MissingFrom > 0 {
+		report.problem("wal is missing from lsn %v", report.Recovery.MissingFrom)
+	}
+	return report, nil
+}
+
+func checkSnapshot(fs FileSystem, dbFileName string, keyring *Keyring, report *CheckReport) error {
+	file, err := openFile(fs, dbFileName)
+	if os.IsNotExist(err) {
+		report.warning("%v does not exist", dbFileName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := newSnapshotReader(file, keyring)
+	if err == io.EOF {
+		report.warning("%v is empty", dbFileName)
+		return nil
+	}
+	if isKeyError(err) { // 壊れているかどうか分からない
+		return fmt.Errorf("%v: %w", dbFileName, err)
+	}
+	if err != nil {
+		report.problem("%v: %v", dbFileName, err)
+		return nil
+	}
+	report.LSN = reader.header.lsn
+	report.Ts = reader.header.ts
+
+	keys := make(map[string]struct{})
+	for {
+		entries, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err == errChecksum {
+			report.problem("%v: checksum mismatch in block %v", dbFileName, reader.blocks-1)
+			continue
+		}
+		if err != nil {
+			report.problem("%v: %v", dbFileName, err)
+			break
+		}
+		for _, entry := range entries {
+			if _, exist := keys[entry.key]; exist {
+				report.problem("%v: duplicate key %q in block %v", dbFileName, entry.key, reader.blocks-1)
+			}
+			keys[entry.key] = struct{}{}
+		}
+	}
+	report.Keys = len(keys)
+	report.Blocks = reader.blocks
+	return nil
+}
+
+func checkWal(fs FileSystem, segments []segment, keys *Keyring, report *CheckReport) error {
+	var lastLSN uint64
+	var begin *walDumpEntry
+	ops := uint32(0)
+	broken := false // 壊れた record の後は次の begin まで tx の形を確かめない
+	for i, seg := range segments {
+		first := true
+		err := dumpSegment(fs, seg.path, keys, func(e *walDumpEntry) {
+			where := fmt.Sprintf("%v:%v", seg.path, e.Offset)
+			switch {
+			case e.Status == statusTorn && i == len(segments)-1:
+				report.warning("%v: torn tail (%v bytes), the last tx is not recovered", where, e.Size)
+				return
+			case e.Status != statusOK:
+				report.problem("%v: %v record", where, e.Status)
+				begin = nil
+				broken = true
+				first = false
+				return
+			}
+
+			if first && e.LSN != seg.firstLSN {
+				report.problem("%v: segment should start at lsn %v, but starts at %v", where, seg.firstLSN, e.LSN)
+			} else if !broken && lastLSN > 0 && e.LSN != lastLSN+1 {
+				report.problem("%v: lsn jumps from %v to %v", where, lastLSN, e.LSN)
+			}
+			first = false
+			lastLSN = e.LSN
+
+			// begin, operation * op count, commit の順になっているか
+			if broken && e.Type != "begin" {
+				return
+			}
+			broken = false
+			switch e.Type {
+			case "begin":
+				if begin != nil {
+					report.problem("%v: tx %v has no commit record", where, begin.Ts)
+				}
+				begin = e
+				ops = 0
+			case "operation":
+				if begin == nil {
+					report.problem("%v: operation outside a tx", where)
+				}
+				ops++
+			case "commit":
+				if begin == nil {
+					report.problem("%v: commit of tx %v without begin", where, e.Ts)
+				} else if begin.Ts != e.Ts || begin.OpCount != ops {
+					report.problem("%v: commit of tx %v does not match its begin", where, e.Ts)
+				}
+				begin = nil
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("%v: %w", seg.path, err)
+		}
+	}
+	return nil
+}
+
+// checkCommand runs `seccampdb check`. It exits with 1 if anything is
+// corrupted.
+func checkCommand(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	dataDir := flags.String("data-dir", ".", "directory of db-file and the wal")
+	dbFileName := flags.String("db", "", "db-file to check (default: db-file in -data-dir)")
+	walFileName := flags.String("wal", "", "wal to check (default: wal in -data-dir)")
+	recoveryPolicy := flags.String("recovery", "stop", "recovery policy Setup would use (stop, skip)")
+	keys := addKeyFlags(flags)
+	flags.Parse(args)
+
+	if *dbFileName == "" {
+		*dbFileName = filepath.Join(*dataDir, DBFileName)
+	}
+	if *walFileName == "" {
+		*walFileName = filepath.Join(*dataDir, WALFileName)
+	}
+	opts := Options{}
+	var err error
+	if opts.RecoveryPolicy, err = ParseRecoveryPolicy(*recoveryPolicy); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if opts.Keys, err = keys.load(); err != nil {
+		fmt.Fprintln(os.Stderr, "check:", err)
+		os.Exit(2)
+	}
+	if err := checkDataDir(*dataDir); err != nil {
+		fmt.Fprintln(os.Stderr, "check:", err)
+		os.Exit(2)
+	}
+	report, err := Check(*walFileName, *dbFileName, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "check:", err)
+		os.Exit(2)
+	}
+	fmt.Print(report)
+	if len(report.Problems) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	walFileName := filepath.Join(dir, "seccampdb.log")
+	dbFileName := filepath.Join(dir, "seccampdb.db")
+
+	snapshot := func(keys ...string) []byte {
+		buf := new(bytes.Buffer)
+		writer, err := newSnapshotWriter(buf, &snapshotHeader{lsn: 3, ts: 1}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			writer.add(key, "value", 1)
+		}
+		writer.close()
+		return buf.Bytes()
+	}
+	wal := new(bytes.Buffer)
+	tw := &testWalWriter{w: wal, lsn: 3}
+	tw.writeTx(2, &Operation{INSERT, &Version{"key2", "value2", 0, 0, nil, false}})
+	tw.writeTx(3, &Operation{UPDATE, &Version{"key1", "value11", 0, 0, nil, false}})
+
+	brokenSnapshot := snapshot("key1")
+	brokenSnapshot[snapshotHeaderSize+blockHeaderSize+1] ^= 0xff
+	brokenWal := append([]byte{}, wal.Bytes()...)
+	brokenWal[recordHeaderSize] ^= 0xff
+
+	tests := []struct {
+		name     string
+		snapshot []byte
+		wal      []byte
+		problems int
+		warnings int
+		refused  bool
+	}{
+		{"ok", snapshot("key1"), wal.Bytes(), 0, 0, false},
+		{"torn tail", snapshot("key1"), wal.Bytes()[:wal.Len()-3], 0, 1, false},
+		{"broken db-file", brokenSnapshot, wal.Bytes(), 2, 0, true}, // block と footer
+		{"duplicate key", snapshot("key1", "key1"), wal.Bytes(), 1, 0, false},
+		{"broken wal", snapshot("key1"), brokenWal, 1, 0, false},
+		{"missing wal", snapshot("key1"), wal.Bytes()[29+32+25:], 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(dbFileName, tt.snapshot, 0666); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(segmentPath(walFileName, 4), append(segmentHeader(), tt.wal...), 0666); err != nil {
+				t.Fatal(err)
+			}
+			report, err := Check(walFileName, dbFileName, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Problems) != tt.problems || len(report.Warnings) != tt.warnings || (report.Refused != nil) != tt.refused {
+				t.Errorf("wrong report:\n%v", report)
+			}
+			if tt.name == "ok" && (report.Keys != 1 || report.Recovery.Committed != 2) {
+				t.Errorf("wrong report:\n%v", report)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var errCheckpointTimeout = errors.New("checkpoint timed out waiting for running txs")
+
+// versionAt returns the version visible at ts, or nil if the key does not
+// exist at ts.
+func (r *Record) versionAt(ts uint64) *Version {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur := r.last
+	for cur != nil && cur.wTs > ts {
+		cur = cur.prev
+	}
+	if cur == nil || cur.deleted {
+		return nil
+	}
+	return cur
+}
+
+// checkpoint writes a consistent snapshot of db-memory at a new ts while txs
+// keep running, then removes the wal segments covered by it.
+//
+// The snapshot contains every tx whose ts is not larger than its ts. Any tx
+// with a larger ts starts after the checkpoint, so its commit record has a
+// larger lsn than the one read here and recovery replays it from the wal.
+func (db *DB) checkpoint(timeout time.Duration) error {
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+
+	tx, lsn, err := db.snapshotTx(timeout)
+	if err != nil {
+		return err
+	}
+	defer tx.DestructTx()
+
+	// db-memory -> db-file
+	if err := db.saveData(tx.ts, lsn); err != nil {
+		return err
+	}
+
+	// remove wal-file
+	db.truncateWal()
+	return nil
+}
+
+// snapshotTx starts a read-only tx whose ts sees a consistent snapshot, and
+// returns it with the lsn of the last wal record before it. It waits until
+// every commit of a tx with a smaller ts finishes; such a tx which has not
+// started its commit yet fails to commit (startCommit), so idle txs do not
+// block checkpoints. The caller must destruct the tx.
+func (db *DB) snapshotTx(timeout time.Duration) (*Tx, uint64, error) {
+	// 読み取り専用の tx として ts を取り、古い version を GC から守る
+	db.aliveTx.mu.Lock()
+	db.committing.mu.Lock()
+	ts := atomic.AddUint64(&db.tsGenerator, 1)
+	db.aliveTx.txs = append(db.aliveTx.txs, ts)
+	db.snapshotTs = ts
+	lsn := db.wal.next() - 1
+	db.committing.mu.Unlock()
+	db.aliveTx.mu.Unlock()
+	tx := &Tx{ts: ts, db: db}
+
+	// ts より小さい tx の commit が全て終わるのを待つ
+	if err := db.waitTxsBefore(ts, timeout); err != nil {
+		tx.DestructTx()
+		return nil, 0, err
+	}
+	return tx, lsn, nil
+}
+
+func (db *DB) waitTxsBefore(ts uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		running := false
+		db.committing.mu.RLock()
+		for _, t := range db.committing.txs {
+			if t < ts {
+				running = true
+				break
+			}
+		}
+		db.committing.mu.RUnlock()
+		if !running {
+			return nil
+		}
+
+		if timeout > 0 && time.Now().After(deadline) {
+			return errCheckpointTimeout
+		}
+		select {
+		case <-db.stop:
+			return errors.New("db is shutting down")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// startCommit registers a tx whose commit is starting, so that checkpoints
+// wait for it. A tx older than the last snapshot fails, because its writes
+// would be neither in the snapshot nor replayed from the wal (its ts is not
+// larger than the ts of db-file).
+func (db *DB) startCommit(ts uint64) error {
+	db.committing.mu.Lock()
+	defer db.committing.mu.Unlock()
+	if ts <= db.snapshotTs {
+		return fmt.Errorf("%w: a checkpoint started after the tx", errCommitFailed)
+	}
+	db.committing.txs = append(db.committing.txs, ts)
+	return nil
+}
+
+func (db *DB) endCommit(ts uint64) {
+	db.committing.mu.Lock()
+	defer db.committing.mu.Unlock()
+	for i, t := range db.committing.txs {
+		if t == ts {
+			db.committing.txs = append(db.committing.txs[:i], db.committing.txs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (db *DB) runCheckpointer(interval time.Duration) {
+	defer db.background.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			if err := db.checkpoint(interval); err != nil {
+				log.Println("checkpoint failed:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDB_Checkpoint(t *testing.T) {
+	dir := t.TempDir()
+	walFileName := filepath.Join(dir, "seccampdb.log")
+	dbFileName := filepath.Join(dir, "seccampdb.db")
+	opts := Options{SegmentSize: 1024}
+	db := NewDB(walFileName, dbFileName, opts)
+	db.Setup()
+
+	// checkpoint 中も tx は動き続ける
+	stop := make(chan struct{})
+	committed := make([]map[string]string, 4)
+	wg := sync.WaitGroup{}
+	for i := range committed {
+		committed[i] = make(map[string]string)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key%v-%v", i, n%10)
+				value := fmt.Sprintf("value%v", n)
+				tx := NewTx(db)
+				if n < 10 {
+					tx.Insert(key, value)
+				} else {
+					tx.Update(key, value)
+				}
+				if _, err := tx.Commit(); err == nil {
+					committed[i][key] = value
+				}
+				tx.DestructTx()
+			}
+		}(i)
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if err := db.checkpoint(time.Second); err != nil {
+			t.Fatalf("failed to checkpoint: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	segments, err := listSegments(osFS{}, walFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) > 0 && segments[0].firstLSN <= 1 {
+		t.Errorf("wal is not truncated: %v", segments)
+	}
+	db.close()
+
+	// crash recovery
+	recovered := NewDB(walFileName, dbFileName, opts)
+	defer recovered.close()
+	if err := recovered.loadData(); err != nil {
+		t.Fatalf("failed to load data: %v", err)
+	}
+	recovered.loadWal()
+	for _, kv := range committed {
+		for key, value := range kv {
+			v, exist := recovered.index.Load(key)
+			if !exist || v.(*Record).last.value != value {
+				t.Errorf("wrong value: %v", key)
+			}
+		}
+	}
+}
+
+func TestDB_Checkpoint_WaitRunningTx(t *testing.T) {
+	db := newTempDB(t, Options{})
+
+	// 開いたままの tx (telnet や binary protocol の session) は待たない
+	idle := NewTx(db)
+	defer idle.DestructTx()
+	idle.Read("key0")
+	if err := db.checkpoint(50 * time.Millisecond); err != nil {
+		t.Fatalf("idle tx should not block a checkpoint: %v", err)
+	}
+	// checkpoint より前の ts で書くと snapshot にも wal の replay にも入らないので衝突する
+	idle.Insert("key0", "value0")
+	if _, err := idle.Commit(); !errors.Is(err, errCommitFailed) {
+		t.Errorf("tx older than the checkpoint should not commit: %v", err)
+	}
+
+	// commit 中の tx は待つ (segment への書き込みを止めておく)
+	db.wal.log.mu.Lock()
+	tx := NewTx(db)
+	if err := tx.Insert("key1", "value1"); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	committed := make(chan error)
+	go func() {
+		_, err := tx.Commit()
+		committed <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := db.checkpoint(50 * time.Millisecond); err != errCheckpointTimeout {
+		t.Fatalf("should be timed out: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- db.checkpoint(time.Second)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	db.wal.log.mu.Unlock()
+	if err := <-committed; err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	tx.DestructTx()
+	if err := <-done; err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	// 後から始まった tx は含まれない
+	newTx := NewTx(db)
+	if err := newTx.Insert("key2", "value2"); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if _, err := newTx.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	newTx.DestructTx()
+
+	snapshot := NewDB(db.wal.log.prefix, db.dbFileName, Options{})
+	defer snapshot.close()
+	if err := snapshot.loadData(); err != nil {
+		t.Fatalf("failed to load data: %v", err)
+	}
+	if _, exist := snapshot.index.Load("key1"); !exist {
+		t.Error("committed tx is not in the snapshot")
+	}
+	if _, exist := snapshot.index.Load("key2"); exist {
+		t.Error("tx after the checkpoint is in the snapshot")
+	}
+	if report := snapshot.loadWal(); report.Committed != 1 {
+		t.Errorf("wrong report: %v", report)
+	}
+	if _, exist := snapshot.index.Load("key2"); !exist {
+		t.Error("tx after the checkpoint is not replayed")
+	}
+}
@@ -0,0 +1,273 @@
+// Package client is the Go client of seccampdb. It speaks the binary protocol
+// (-binary-addr of the server), so keys and values can contain any bytes.
+//
+//	c, err := client.Dial(ctx, "localhost:7778", client.Options{})
+//	tx, err := c.Begin(ctx)
+//	value, err := tx.Get(ctx, "key")
+//	err = tx.Put(ctx, "key", []byte("value"))
+//	err = tx.Commit(ctx) // errors.Is(err, client.ErrConflict) なら tx をやり直す
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const DefaultMaxIdleConns = 4
+
+var (
+	ErrNotFound = errors.New("client: key not found")
+	ErrConflict = errors.New("client: conflict with another transaction, retry it")
+	ErrServer   = errors.New("client: server error")
+	ErrClosed   = errors.New("client: client is closed")
+	ErrTxDone   = errors.New("client: transaction has already been committed or rolled back")
+)
+
+// Error is an error returned by the server. errors.Is reports ErrNotFound,
+// ErrConflict or ErrServer (any other code) for it.
+type Error struct {
+	Code    uint16
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("seccampdb: %v (code %v)", e.Message, e.Code)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Code == CodeNotFound
+	case ErrConflict:
+		return e.Code == CodeConflict
+	case ErrServer:
+		return e.Code != CodeNotFound && e.Code != CodeConflict
+	}
+	return false
+}
+
+// Options configures a Client. The zero value is a valid configuration.
+type Options struct {
+	MaxIdleConns int // idle connections kept in the pool, 0 means DefaultMaxIdleConns
+	MaxOpenConns int // connections (idle or running a tx), 0 means no limit
+}
+
+// Client is a pool of connections to a server. It is safe for concurrent use.
+type Client struct {
+	addr   string
+	opts   Options
+	dialer net.Dialer
+	open   chan struct{} // semaphore of MaxOpenConns, nil if no limit
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// Dial connects to the server at addr and returns a client pooling the
+// connections to it.
+func Dial(ctx context.Context, addr string, opts Options) (*Client, error) {
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = DefaultMaxIdleConns
+	}
+	c := &Client{addr: addr, opts: opts}
+	if opts.MaxOpenConns > 0 {
+		c.open = make(chan struct{}, opts.MaxOpenConns)
+	}
+	// 最初の connection で server に繋がることを確かめる
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.put(conn)
+	return c, nil
+}
+
+// Close closes the idle connections. The connections of running txs are
+// closed when the txs end.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, conn := range c.idle {
+		conn.close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// get returns an idle connection or a new one, waiting for MaxOpenConns.
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	if c.open != nil {
+		select {
+		case c.open <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		c.release()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	nc, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+	return newConn(nc), nil
+}
+
+// put returns conn to the pool, or closes it if it is broken or the pool is
+// full.
+func (c *Client) put(conn *conn) {
+	defer c.release()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn.broken || c.closed || len(c.idle) >= c.opts.MaxIdleConns {
+		conn.close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+func (c *Client) release() {
+	if c.open != nil {
+		<-c.open
+	}
+}
+
+// Begin starts a tx on a connection of the pool. The connection is returned
+// to the pool by Commit or Rollback, so one of them has to be called.
+func (c *Client) Begin(ctx context.Context) (*Tx, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{client: c, conn: conn}, nil
+}
+
+// Get reads key in its own tx.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx) // 読むだけなので commit しない
+	return tx.Get(ctx, key)
+}
+
+// Put writes key in its own tx.
+func (c *Client) Put(ctx context.Context, key string, value []byte) error {
+	return c.update(ctx, func(tx *Tx) error { return tx.Put(ctx, key, value) })
+}
+
+// Delete deletes key in its own tx.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.update(ctx, func(tx *Tx) error { return tx.Delete(ctx, key) })
+}
+
+func (c *Client) update(ctx context.Context, fn func(tx *Tx) error) error {
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Tx is a tx running on a connection. It is not safe for concurrent use.
+type Tx struct {
+	client *Client
+	conn   *conn // nil after Commit or Rollback
+}
+
+// do sends a request of the tx. A server error is returned as *Error.
+func (tx *Tx) do(ctx context.Context, op uint8, key string, value []byte) ([]byte, error) {
+	if tx.conn == nil {
+		return nil, ErrTxDone
+	}
+	resp, err := tx.conn.roundTrip(ctx, op, key, value)
+	if err != nil {
+		// 切断すると server が tx を abort する
+		tx.conn.broken = true
+		tx.end()
+		return nil, err
+	}
+	if resp.status == statusAborted {
+		tx.end()
+	}
+	if resp.status != statusOK {
+		return nil, &Error{Code: resp.code, Message: string(resp.body)}
+	}
+	return resp.body, nil
+}
+
+func (tx *Tx) end() {
+	tx.client.put(tx.conn)
+	tx.conn = nil
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (tx *Tx) Get(ctx context.Context, key string) ([]byte, error) {
+	return tx.do(ctx, opRead, key, nil)
+}
+
+// Put inserts key if it does not exist and updates it otherwise.
+func (tx *Tx) Put(ctx context.Context, key string, value []byte) error {
+	_, err := tx.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		_, err = tx.do(ctx, opInsert, key, value)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.do(ctx, opUpdate, key, value)
+	return err
+}
+
+// Delete deletes key, or returns ErrNotFound.
+func (tx *Tx) Delete(ctx context.Context, key string) error {
+	// server は commit まで key の有無を確かめないので先に読む
+	if _, err := tx.Get(ctx, key); err != nil {
+		return err
+	}
+	_, err := tx.do(ctx, opDelete, key, nil)
+	return err
+}
+
+// Commit commits the tx. ErrConflict means that the tx conflicted with
+// another one and can be retried.
+func (tx *Tx) Commit(ctx context.Context) error {
+	_, err := tx.do(ctx, opCommit, "", nil)
+	if tx.conn != nil { // server は COMMIT の後に次の tx を始める
+		tx.end()
+	}
+	return err
+}
+
+// Rollback aborts the tx. It returns ErrTxDone after Commit or Rollback, so
+// it can be deferred.
+func (tx *Tx) Rollback(ctx context.Context) error {
+	_, err := tx.do(ctx, opAbort, "", nil)
+	if tx.conn != nil {
+		tx.end()
+	}
+	return err
+}
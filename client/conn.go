@@ -0,0 +1,155 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// binary protocol (README.md, protocol.go と同じ値)
+const (
+	frameHeaderSize = 4
+	maxFrameSize    = 64 << 20
+
+	opRead   = 1
+	opInsert = 2
+	opUpdate = 3
+	opDelete = 4
+	opCommit = 5
+	opAbort  = 6
+
+	statusOK      = 0
+	statusError   = 1 // the operation failed, the tx continues
+	statusAborted = 2 // the tx is aborted
+)
+
+// error code
+const (
+	CodeInternal      uint16 = 1
+	CodeBadRequest    uint16 = 2
+	CodeNotFound      uint16 = 3
+	CodeAlreadyExists uint16 = 4
+	CodeConflict      uint16 = 5 // commit failed because of another tx
+	CodeReadOnly      uint16 = 6
+)
+
+var (
+	errFrameTooLarge = errors.New("client: frame too large")
+	errBadResponse   = errors.New("client: bad response")
+)
+
+// conn is a connection to the server. It runs one tx at a time.
+type conn struct {
+	nc     net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	broken bool // closed instead of being pooled, e.g. after an I/O error
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{nc: nc, reader: bufio.NewReader(nc), writer: bufio.NewWriter(nc)}
+}
+
+type response struct {
+	status uint8
+	code   uint16
+	body   []byte
+}
+
+// roundTrip sends a request and reads its response until ctx is done.
+func (c *conn) roundTrip(ctx context.Context, op uint8, key string, value []byte) (*response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	payload := []byte{op}
+	switch op {
+	case opRead, opInsert, opUpdate, opDelete:
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(key)))
+		payload = append(payload, size[:]...)
+		payload = append(payload, key...)
+		payload = append(payload, value...)
+	}
+	if len(payload) > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+
+	// deadline は ctx の deadline、cancel されたら過去にして読み書きを止める
+	deadline, _ := ctx.Deadline()
+	c.nc.SetDeadline(deadline)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			c.nc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	resp, err := c.send(payload)
+	if err != nil {
+		c.broken = true
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		// ctx の timer より先に deadline を過ぎることがある
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && !deadline.IsZero() {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *conn) send(payload []byte) (*response, error) {
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	c.writer.Write(header[:])
+	c.writer.Write(payload)
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, buf); err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("%w: empty response", errBadResponse)
+	}
+	resp := &response{status: buf[0], body: buf[1:]}
+	switch resp.status {
+	case statusOK:
+	case statusError, statusAborted:
+		if len(resp.body) < 2 {
+			return nil, fmt.Errorf("%w: error code is missing", errBadResponse)
+		}
+		resp.code = binary.BigEndian.Uint16(resp.body)
+		resp.body = resp.body[2:]
+	default:
+		return nil, fmt.Errorf("%w: unknown status %v", errBadResponse, resp.status)
+	}
+	return resp, nil
+}
+
+func (c *conn) close() error {
+	return c.nc.Close()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KodaiD/seccamp_db_golang/client"
+)
+
+// startBinaryServer serves the binary protocol of db on a local port.
+func startBinaryServer(t *testing.T, db *DB) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go db.ServeBinary(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func newTestClient(t *testing.T, opts client.Options) *client.Client {
+	db := newTempDB(t, Options{})
+	c, err := client.Dial(context.Background(), startBinaryServer(t, db), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, client.Options{})
+
+	key := "key with\nspaces"
+	value := []byte{0, 1, ' ', '\n', 0xff}
+	if _, err := c.Get(ctx, key); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("get of a missing key: %v", err)
+	}
+	if err := c.Put(ctx, key, value); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get(ctx, key); err != nil || !bytes.Equal(got, value) {
+		t.Errorf("get: %q, %v", got, err)
+	}
+
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(ctx, key, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(ctx, "key2", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tx.Get(ctx, key); err != nil || string(got) != "2" {
+		t.Errorf("get in the tx: %q, %v", got, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err != client.ErrTxDone {
+		t.Errorf("second commit: %v", err)
+	}
+
+	// rollback すると何も書かない
+	tx, err = c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete(ctx, "key2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get(ctx, "key2"); err != nil || string(got) != "3" {
+		t.Errorf("get after rollback: %q, %v", got, err)
+	}
+
+	if err := c.Delete(ctx, "key2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "key2"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("delete of a missing key: %v", err)
+	}
+}
+
+func TestClient_Conflict(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, client.Options{})
+
+	tx1, _ := c.Begin(ctx)
+	tx2, _ := c.Begin(ctx)
+	if err := tx1.Put(ctx, "key", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Put(ctx, "key", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err := tx2.Commit(ctx)
+	var serverErr *client.Error
+	if !errors.Is(err, client.ErrConflict) || errors.Is(err, client.ErrServer) || !errors.As(err, &serverErr) || serverErr.Code != client.CodeConflict {
+		t.Errorf("commit of a conflicting tx: %v", err)
+	}
+	if err := tx2.Rollback(ctx); err != client.ErrTxDone {
+		t.Errorf("rollback after an aborted commit: %v", err)
+	}
+}
+
+func TestClient_Pool(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, client.Options{MaxOpenConns: 1})
+
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// connection が空くまで待つ
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Begin(timeout); err != context.DeadlineExceeded {
+		t.Errorf("begin without a free connection: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- c.Put(ctx, "key", []byte("1"))
+	}()
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("put after rollback: %v", err)
+	}
+
+	c.Close()
+	if _, err := c.Begin(ctx); err != client.ErrClosed {
+		t.Errorf("begin after close: %v", err)
+	}
+}
+
+func TestClient_Deadline(t *testing.T) {
+	// 何も返さない server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	c, err := client.Dial(context.Background(), listener.Addr().String(), client.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, "key"); err != context.DeadlineExceeded {
+		t.Errorf("get with a deadline: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := c.Put(ctx, "key", []byte("1")); err != context.Canceled {
+		t.Errorf("put with a canceled context: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// compression
+// db-file の block と大きな wal record を圧縮する
+// codec は file header の flags の上位 8 bit に書く
+// 圧縮された wal record は type の最上位 bit が立っている (暗号化する前に圧縮する)
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	FlateCompression
+)
+
+const (
+	codecShift      = 8
+	codecMask       = 0xff << codecShift
+	recCompressed   = 0x80
+	compressMinSize = 1 << 10 // これより小さい wal record は圧縮しない
+)
+
+var errCompression = errors.New("unknown compression")
+
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "none":
+		return NoCompression, nil
+	case "flate":
+		return FlateCompression, nil
+	}
+	return 0, fmt.Errorf("%w: %v (none, flate)", errCompression, s)
+}
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case FlateCompression:
+		return "flate"
+	}
+	return fmt.Sprintf("unknown(%v)", uint8(c))
+}
+
+// flags returns the header flags recording c.
+func (c Compression) flags() uint16 {
+	return uint16(c) << codecShift
+}
+
+// compressionOf returns the codec recorded in the flags of a file header.
+func compressionOf(flags uint16) (Compression, error) {
+	c := Compression(flags >> codecShift)
+	if c > FlateCompression {
+		return 0, fmt.Errorf("%w %v", errCompression, uint8(c))
+	}
+	return c, nil
+}
+
+func (c Compression) compress(buf []byte) []byte {
+	if c == NoCompression {
+		return buf
+	}
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		panic(err) // level は正しい
+	}
+	w.Write(buf) // bytes.Buffer への書き込みは失敗しない
+	w.Close()
+	return b.Bytes()
+}
+
+func (c Compression) decompress(buf []byte) ([]byte, error) {
+	if c == NoCompression {
+		return buf, nil
+	}
+	r := flate.NewReader(bytes.NewReader(buf))
+	defer r.Close()
+	plain, err := ioutil.ReadAll(io.LimitReader(r, maxRecordSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) > maxRecordSize {
+		return nil, errors.New("decompressed data too large")
+	}
+	return plain, nil
+}
+
+// compressRecord compresses the body of an encoded wal record if it is large
+// and becomes smaller.
+func (c Compression) compressRecord(buf []byte) []byte {
+	if c == NoCompression || len(buf) < compressMinSize {
+		return buf
+	}
+	body := c.compress(buf[recordHeaderSize : len(buf)-checksumSize])
+	if recordHeaderSize+len(body)+checksumSize >= len(buf) {
+		return buf
+	}
+	return withBody(buf, buf[12]|recCompressed, body)
+}
+
+// decompressRecord returns the encoded wal record compressed by compressRecord.
+func (c Compression) decompressRecord(buf []byte) ([]byte, error) {
+	typ := buf[12]
+	if typ&recCompressed == 0 {
+		return buf, nil
+	}
+	if c == NoCompression {
+		return nil, errBrokenRecord
+	}
+	body, err := c.decompress(buf[recordHeaderSize : len(buf)-checksumSize])
+	if err != nil {
+		return nil, errBrokenRecord
+	}
+	return withBody(buf, typ&^recCompressed, body), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompressRecord(t *testing.T) {
+	value := strings.Repeat(`{"name": "seccampdb", "tags": ["mvto", "wal"]}`, 100)
+	buf, err := encodeRecord(&walRecord{lsn: 5, typ: recOperation, op: &Operation{cmd: INSERT, version: &Version{key: "key", value: value}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []walFormat{
+		{codec: FlateCompression},
+		{codec: FlateCompression, key: testKeyring(t, bytes.Repeat([]byte{1}, 16)).encryptKey()},
+	} {
+		packed := format.pack(buf)
+		if len(packed) >= len(buf)/2 || packed[12]&recCompressed == 0 {
+			t.Fatalf("not compressed: %v bytes", len(packed))
+		}
+		reader, err := newWALReader(bytes.NewReader(packed), format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := reader.next()
+		if err != nil || rec.lsn != 5 || rec.op.version.key != "key" || rec.op.version.value != value {
+			t.Fatalf("got %+v, %v", rec, err)
+		}
+	}
+
+	// 小さい record は圧縮しない
+	small, err := encodeRecord(&walRecord{typ: recCommit, ts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packed := (walFormat{codec: FlateCompression}).pack(small); !bytes.Equal(packed, small) {
+		t.Errorf("small record is compressed: %v", packed)
+	}
+}
+
+func TestDB_Compression(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	mem := newMemFS()
+	mem.MkdirAll("/db", 0777)
+	value := strings.Repeat(`{"name": "seccampdb", "tags": ["mvto", "wal"]}`, 1000)
+	size := func() int {
+		n := 0
+		for _, inode := range mem.files {
+			n += len(inode.data)
+		}
+		return n
+	}
+
+	db := NewDB("/db/seccampdb.log", "/db/seccampdb.db", Options{FS: mem, Compression: FlateCompression})
+	if err := db.setup(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2"} {
+		tx := NewTx(db)
+		tx.Insert(key, value)
+		if _, err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		tx.DestructTx()
+	}
+	db.close()
+	if n := size(); n > len(value) {
+		t.Errorf("wal is not compressed: %v bytes", n)
+	}
+
+	// wal -> 圧縮した db-file
+	db = NewDB("/db/seccampdb.log", "/db/seccampdb.db", Options{FS: mem, Compression: FlateCompression})
+	if err := db.setup(); err != nil {
+		t.Fatal(err)
+	}
+	db.close()
+	if n := size(); n > len(value) {
+		t.Errorf("db-file is not compressed: %v bytes", n)
+	}
+
+	// 圧縮しない設定でも読める
+	db = NewDB("/db/seccampdb.log", "/db/seccampdb.db", Options{FS: mem})
+	if err := db.setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	for _, key := range []string{"key1", "key2"} {
+		record, exist := db.index.Load(key)
+		if !exist || record.(*Record).last.value != value {
+			t.Errorf("%v is not recovered", key)
+		}
+	}
+}
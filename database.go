@@ -1,16 +1,14 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"log"
-	"net"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // supported operation
@@ -23,13 +21,55 @@ const (
 	ABORT
 )
 
+// Options configures a DB. The zero value is a valid configuration.
+type Options struct {
+	RecoveryPolicy RecoveryPolicy
+	ForceRecovery  bool // load a broken db-file as far as possible
+
+	// group commit
+	GroupCommitSize int           // max number of txs written by one fsync
+	GroupCommitWait time.Duration // how long the flusher waits for more txs
+
+	// durability (txs can override it)
+	Durability   Durability
+	SyncInterval time.Duration // fsync interval of BackgroundSync txs
+
+	// wal segment
+	SegmentSize int64  // a new segment is started when the last one is larger
+	ArchiveDir  string // old segments are moved here instead of being deleted
+
+	CheckpointInterval time.Duration // 0 disables the background checkpointer
+
+	FS          FileSystem  // storage of db-file and the wal, nil means the OS file system
+	Keys        *Keyring    // encryption at rest, nil disables it
+	Compression Compression // codec of db-file blocks and large wal records
+}
+
+func (opts *Options) fileSystem() FileSystem {
+	if opts.FS == nil {
+		return osFS{}
+	}
+	return opts.FS
+}
+
 type DB struct {
-	walMu       sync.Mutex
-	wALFile     *os.File
-	dBFile      *os.File
-	index       sync.Map
-	tsGenerator uint64
-	aliveTx     AliveTx
+	opts          Options
+	fs            FileSystem
+	wal           *groupCommitter
+	dBFile        File
+	dbFileName    string
+	checkpointMu  sync.Mutex
+	checkpointLSN uint64 // この lsn までに commit された tx は db-file に含まれる
+	checkpointTs  uint64 // この ts 以下の tx は db-file に含まれる
+	stop          chan struct{}
+	background    sync.WaitGroup
+	target        *RecoveryTarget // restore の時だけ使う
+	dataDir       *DataDir        // DB と一緒に閉じる (file 名で開いたら nil)
+	index         sync.Map
+	tsGenerator   uint64
+	aliveTx       AliveTx
+	committing    AliveTx // commit 中の tx (checkpoint はこれだけを待つ)
+	snapshotTs    uint64  // 最後に checkpoint (backup) が取った ts (committing.mu で守る)
 }
 
 type AliveTx struct {
@@ -37,270 +77,298 @@ type AliveTx struct {
 	mu  sync.RWMutex
 }
 
-func NewDB(walFileName, dbFileName string) *DB {
-	walFile, err := os.OpenFile(walFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+func NewDB(walFileName, dbFileName string, opts Options) *DB {
+	fs := opts.fileSystem()
+	format := walFormat{key: opts.Keys.encryptKey(), codec: opts.Compression}
+	walLog, err := openSegmentedLog(fs, walFileName, opts.SegmentSize, opts.ArchiveDir, format)
 	if err != nil {
 		log.Fatal(err)
 	}
-	dbFile, err := os.OpenFile(dbFileName, os.O_CREATE|os.O_RDONLY, 0666)
+	dbFile, err := fs.OpenFile(dbFileName, os.O_CREATE|os.O_RDONLY, 0666)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	return &DB{
-		wALFile:     walFile,
-		dBFile:      dbFile,
-		index:       sync.Map{},
-		tsGenerator: 0,
-		aliveTx:     AliveTx{},
+		opts:          opts,
+		fs:            fs,
+		wal:           newGroupCommitter(walLog, opts.GroupCommitSize, opts.GroupCommitWait, opts.SyncInterval),
+		dBFile:        dbFile,
+		dbFileName:    dbFileName,
+		checkpointLSN: 0,
+		checkpointTs:  0,
+		stop:          make(chan struct{}),
+		index:         sync.Map{},
+		tsGenerator:   0,
+		aliveTx:       AliveTx{},
 	}
 }
 
+// DurableLSN returns the lsn up to which all wal records are durable.
+func (db *DB) DurableLSN() uint64 {
+	return db.wal.durable()
+}
+
+// Degraded returns why the DB is read-only, or nil. The DB becomes read-only
+// when the wal cannot be written, and stays so until it is restarted.
+func (db *DB) Degraded() error {
+	return db.wal.err()
+}
+
+// CheckpointLSN returns the lsn of the last wal record the db-file covers.
+func (db *DB) CheckpointLSN() uint64 {
+	return atomic.LoadUint64(&db.checkpointLSN)
+}
+
 func (db *DB) Shutdown() {
 	fmt.Println("shut down...")
+	if err := db.shutdown(); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+// shutdown writes db-memory to db-file and closes the DB and its data
+// directory.
+func (db *DB) shutdown() error {
+	// checkpointer を止め、書き込み待ちの wal を全て永続化する
+	db.stopBackground()
+	db.wal.close()
 
 	// db-memory -> DB-file
-	db.saveData()
-	// clear wal-file
-	db.clearFile()
-	if err := db.wALFile.Close(); err != nil {
+	db.checkpointMu.Lock()
+	err := db.saveData(atomic.LoadUint64(&db.tsGenerator), db.wal.durable())
+	db.checkpointMu.Unlock()
+	if err != nil {
+		return err
+	}
+	// remove wal-file
+	db.truncateWal()
+	db.close()
+	return nil
+}
+
+func (db *DB) stopBackground() {
+	select {
+	case <-db.stop:
+	default:
+		close(db.stop)
+	}
+	db.background.Wait()
+}
+
+func (db *DB) close() {
+	db.stopBackground()
+	db.wal.close()
+	if err := db.wal.log.close(); err != nil {
 		log.Println(err)
 	}
 	if err := db.dBFile.Close(); err != nil {
 		log.Println(err)
 	}
-
-	os.Exit(0)
+	// lock を外す (windows では LOCK file を消す)
+	if db.dataDir != nil {
+		if err := db.dataDir.Close(); err != nil {
+			log.Println(err)
+		}
+	}
 }
 
 func (db *DB) Setup() {
-	// crash recovery (db-file -> db-memory)
-	db.loadData()
-
-	// crash recovery (wal-file -> db-memory)
-	db.loadWal()
-
-	// checkpointing (db-memory -> db-file)
-	db.saveData()
-
-	// clear log-file
-	db.clearFile()
+	if err := db.setup(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func (db *DB) StartTx(conn net.Conn) {
-	tx := NewTx(db)
-	scanner := bufio.NewScanner(conn)
-	for {
-		conn.Write([]byte("seccampdb >> "))
-		if scanner.Scan() {
-			input := strings.Fields(scanner.Text())
-			cmd := input[0]
-			switch cmd {
-			case "read":
-				if len(input) != 2 {
-					conn.Write([]byte("wrong format -> read <key>\n"))
-					continue
-				}
-				key := input[1]
-				value, err := tx.Read(key)
-				if err != nil {
-					conn.Write([]byte(err.Error() + "\n"))
-
-				} else {
-					conn.Write([]byte(value + "\n"))
-				}
-			case "insert":
-				if len(input) != 3 {
-					conn.Write([]byte("wrong format -> insert <key> <value>\n"))
-					continue
-				}
-				key := input[1]
-				value := input[2]
-				if err := tx.Insert(key, value); err != nil {
-					conn.Write([]byte(err.Error() + "\n"))
-				}
-			case "update":
-				if len(input) != 3 {
-					conn.Write([]byte("wrong format -> update <key> <value>\n"))
-					continue
-				}
-				key := input[1]
-				value := input[2]
-				if err := tx.Update(key, value); err != nil {
-					conn.Write([]byte(err.Error() + "\n"))
-				}
-			case "delete":
-				if len(input) != 2 {
-					conn.Write([]byte("wrong format -> delete <key>\n"))
-					continue
-				}
-				key := input[1]
-				if err := tx.Delete(key); err != nil {
-					conn.Write([]byte(err.Error() + "\n"))
-				}
-			case "commit":
-				if err := tx.Commit(); err != nil {
-					conn.Write([]byte(err.Error() + "\n"))
-				}
-				conn.Write([]byte("committed\n"))
-				fmt.Println("committed")
-				conn.Close()
-				return
-			case "abort":
-				tx.DestructTx()
-				conn.Write([]byte("aborted\n"))
-				fmt.Println("aborted")
-				conn.Close()
-				return
-			case "all":
-				readAll(&db.index) // TODO:
-			default:
-				conn.Write([]byte("command not supported\n"))
-			}
-		}
+func (db *DB) setup() error {
+	// crash recovery (db-file -> db-memory)
+	if err := db.loadData(); err != nil {
+		return err
 	}
-}
 
-func (db *DB) loadWal() {
-	reader := bufio.NewReader(db.wALFile)
-	for {
-		buf := make([]byte, 4096)
+	// 鍵の無い segment を壊れた record として捨てないようにする
+	if err := checkSegmentKeys(db.fs, db.wal.log.list(), db.opts.Keys); err != nil {
+		return err
+	}
 
-		if _, err := reader.Read(buf); err != nil {
-			if err == io.EOF { // 全て読み終わった
-				break
-			}
-			log.Println("cannot do crash recovery")
-			continue // 次の4KiBを読みにいく
-		}
+	// crash recovery (wal-file -> db-memory)
+	report := db.loadWal()
+	log.Println(report)
+	lastLSN := db.checkpointLSN
+	if report.LastLSN > lastLSN {
+		lastLSN = report.LastLSN
+	}
+	db.wal.resetLSN(lastLSN)
 
-		idx := uint(0)
-		for buf[idx] != 0 {
-			size, op, checksum := deserialize(buf, idx)
+	// 再起動前に使われた ts より大きい ts から始める
+	lastTs := db.checkpointTs
+	if report.LastTs > lastTs {
+		lastTs = report.LastTs
+	}
+	atomic.StoreUint64(&db.tsGenerator, lastTs)
 
-			if checksum != crc32.ChecksumIEEE([]byte(op.version.key)) {
-				fmt.Println("load failed")
-				continue
-			}
+	// checkpointing (db-memory -> db-file)
+	if err := db.saveData(atomic.LoadUint64(&db.tsGenerator), lastLSN); err != nil {
+		return err
+	}
 
-			switch op.cmd {
-			case INSERT:
-				record := Record{
-					key:  op.version.key,
-					last: op.version,
-				}
-				db.index.Store(op.version.key, &record)
-			case UPDATE:
-				record := Record{
-					key:  op.version.key,
-					last: op.version,
-				}
-				db.index.Store(op.version.key, &record)
-			case DELETE:
-				db.index.Delete(op.version.key)
-			}
-			idx += size
+	// 壊れた record (や無い segment) より後の segment を残すと、その lsn が新しい
+	// record に再利用される (db-file に lastLSN まで書いた後なので、隔離しても replay
+	// した record は失われない)
+	if report.Corrupted > 0 || report.MissingFrom > 0 {
+		quarantined, err := db.wal.log.quarantineAfter(lastLSN, report.Corrupted == 0)
+		if err != nil {
+			return err
+		}
+		for _, name := range quarantined {
+			log.Println("quarantined wal segment:", name)
 		}
 	}
-}
-
-func serialize(buf []byte, idx uint, op *Operation, checksum uint32) uint {
-	size := uint(len(op.version.key) + len(op.version.value) + 7)
-	buf[idx] = uint8(size)
-	buf[idx+1] = uint8(len(op.version.key))
-	buf[idx+2] = op.cmd
-	copy(buf[idx+3:], op.version.key)
-	copy(buf[idx+3+uint(len(op.version.key)):], op.version.value)
-	binary.BigEndian.PutUint32(buf[idx+size-4:], checksum)
 
-	return size
-}
+	// remove log-file
+	db.truncateWal()
 
-func deserialize(buf []byte, idx uint) (uint, *Operation, uint32) {
-	size := uint(buf[idx])
-	keySize := uint(buf[idx+1])
-	cmd := buf[idx+2]
-	key := string(buf[idx+3 : idx+3+keySize])
-	value := string(buf[idx+3+keySize : idx+size-4])
-	checksum := binary.BigEndian.Uint32(buf[idx+size-4 : idx+size])
-
-	op := &Operation{
-		cmd: cmd,
-		version: &Version{
-			key:   key,
-			value: value,
-			wTs:   0,
-			rTs:   0,
-			prev:  nil,
-		},
-	}
-
-	return size, op, checksum
+	if db.opts.CheckpointInterval > 0 {
+		db.background.Add(1)
+		go db.runCheckpointer(db.opts.CheckpointInterval)
+	}
+	return nil
 }
 
-func (db *DB) saveData() {
-	tmpFile, err := os.Create(TmpFileName)
+// saveData writes db-memory at ts to db-file (format: snapshot.go).
+// db-file は ts 以下の tx を全て含み、lsn 以前に commit された tx の ts は全て ts 以下
+func (db *DB) saveData(ts, lsn uint64) error {
+	tmpFileName := filepath.Join(filepath.Dir(db.dbFileName), TmpFileName)
+	tmpFile, err := createFile(db.fs, tmpFileName)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err = db.writeSnapshot(tmpFile, ts, lsn); err != nil {
+		tmpFile.Close()
+		return err
 	}
-	db.index.Range(func(k, v interface{}) bool {
-		key := k.(string)
-		record := v.(*Record)
-		line := key + " " + record.last.value + "\n"
-		_, err := tmpFile.WriteString(line)
-		if err != nil {
-			log.Println(err)
-		}
-		return true
-	})
 	if err = tmpFile.Sync(); err != nil {
-		log.Fatal(err)
+		tmpFile.Close()
+		return err
 	}
-	if err = os.Rename(TmpFileName, DBFileName); err != nil {
-		log.Fatal(err)
+	if err = db.fs.Rename(tmpFileName, db.dbFileName); err != nil {
+		tmpFile.Close()
+		return err
 	}
-	if err := tmpFile.Sync(); err != nil {
+	if err := db.fs.SyncDir(filepath.Dir(db.dbFileName)); err != nil {
 		log.Println(err)
 	}
 	if err := db.dBFile.Close(); err != nil {
 		log.Println(err)
 	}
 	db.dBFile = tmpFile
+	if db.opts.ArchiveDir != "" {
+		// point-in-time recovery の起点として残す
+		if err := db.archiveSnapshot(lsn); err != nil {
+			log.Println("cannot archive db-file:", err)
+		}
+	}
+	atomic.StoreUint64(&db.checkpointLSN, lsn)
+	atomic.StoreUint64(&db.checkpointTs, ts)
+	return nil
 }
 
-func (db *DB) loadData() {
-	scanner := bufio.NewScanner(db.dBFile)
-	for scanner.Scan() {
-		line := strings.Fields(scanner.Text())
-		if len(line) != 2 {
-			fmt.Println("broken data")
+// writeSnapshot writes db-memory at ts to w in the db-file format.
+func (db *DB) writeSnapshot(w io.Writer, ts, lsn uint64) error {
+	writer, err := newSnapshotWriter(w, &snapshotHeader{lsn: lsn, ts: ts, codec: db.opts.Compression}, db.opts.Keys.encryptKey())
+	if err != nil {
+		return err
+	}
+	db.index.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		version := v.(*Record).versionAt(ts)
+		if version == nil {
+			return true
 		}
-		key := line[0]
-		value := line[1]
-		version := &Version{
-			key:   key,
-			value: value,
-			wTs:   0,
-			rTs:   0,
-			prev:  nil,
+		err = writer.add(key, version.value, version.wTs)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return writer.close()
+}
+
+// loadData loads db-file into db-memory. A broken db-file is an error unless
+// ForceRecovery is set, in which case every readable block is loaded.
+func (db *DB) loadData() error {
+	if _, err := db.dBFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := db.loadSnapshot(db.dBFile); err != nil {
+		if isKeyError(err) {
+			return fmt.Errorf("%v: %w", db.dbFileName, err)
 		}
-		db.index.Store(key, &Record{
-			key:  key,
-			last: version,
-			mu:   sync.Mutex{},
-		})
-		// fmt.Println("recovering...")
+		return err
 	}
+	return nil
 }
 
-func (db *DB) clearFile() {
-	if err := db.wALFile.Truncate(0); err != nil {
-		log.Println(err)
+// loadSnapshot loads a db-file read from r into db-memory.
+func (db *DB) loadSnapshot(r io.Reader) error {
+	reader, err := newSnapshotReader(r, db.opts.Keys)
+	if err == io.EOF { // db-file がまだ無い
+		return nil
 	}
-	if _, err := db.wALFile.Seek(0, 0); err != nil {
-		log.Println(err)
+	if isKeyError(err) { // 鍵が違うだけなので壊れた db-file として扱わない
+		return err
 	}
-	if err := db.wALFile.Sync(); err != nil {
+	if err != nil {
+		return db.forceRecovery(err)
+	}
+	db.checkpointLSN = reader.header.lsn
+	db.checkpointTs = reader.header.ts
+
+	for {
+		entries, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == errChecksum {
+			err = fmt.Errorf("%w: checksum mismatch in block %v", errBrokenSnapshot, reader.blocks-1)
+			if err := db.forceRecovery(err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return db.forceRecovery(err)
+		}
+
+		for _, entry := range entries {
+			version := &Version{
+				key:   entry.key,
+				value: entry.value,
+				wTs:   entry.wTs,
+				rTs:   entry.wTs,
+				prev:  nil,
+			}
+			db.index.Store(entry.key, &Record{
+				key:  entry.key,
+				last: version,
+				mu:   sync.Mutex{},
+			})
+		}
+	}
+}
+
+// forceRecovery ignores err of a broken db-file if ForceRecovery is set.
+func (db *DB) forceRecovery(err error) error {
+	if !db.opts.ForceRecovery {
+		return fmt.Errorf("%w (start with -force-recovery to load what is readable)", err)
+	}
+	log.Println("ignore:", err)
+	return nil
+}
+
+// truncateWal deletes (or archives) the wal segments covered by db-file
+func (db *DB) truncateWal() {
+	if err := db.wal.log.removeBefore(db.CheckpointLSN()); err != nil {
 		log.Println(err)
 	}
 }
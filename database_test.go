@@ -1,10 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"hash/crc32"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 )
@@ -15,23 +16,25 @@ const (
 )
 
 func TestDB_LoadData(t *testing.T) {
-	generateTestData()
-	db := NewTestDB()
-	defer db.dBFile.Close()
-	defer db.wALFile.Close()
+	dir := t.TempDir()
+	generateTestData(dir)
+	db := OpenTestDB(dir)
+	defer db.close()
 
 	// crash recovery (db-file -> db-memory)
-	db.loadData()
-	if record, _ := db.index.Load("test1"); record.(Record).last.value != "value1" {
+	if err := db.loadData(); err != nil {
+		t.Fatalf("failed to load data: %v", err)
+	}
+	if record, _ := db.index.Load("test1"); record.(*Record).last.value != "value1" {
 		t.Error("failed to load data")
 	}
 }
 
 func TestDB_LoadWal(t *testing.T) {
-	db := NewTestDB()
-	generateTestData()
-	defer db.dBFile.Close()
-	defer db.wALFile.Close()
+	dir := t.TempDir()
+	generateTestData(dir)
+	db := OpenTestDB(dir)
+	defer db.close()
 
 	v1 := &Version{
 		key:     "key1",
@@ -81,28 +84,71 @@ func TestDB_LoadWal(t *testing.T) {
 	if v, exist := db.index.Load("test3"); !exist || v.(*Record).last.value != "new_value3" {
 		t.Error("failed to update")
 	}
+	if v, _ := db.index.Load("test4"); v.(*Record).last.wTs != 1 {
+		t.Errorf("recovered version should keep its ts: %v", v.(*Record).last.wTs)
+	}
 }
 
-func generateTestData() {
-	walFile, err := os.Create(TestWALFileName)
-	if err != nil {
-		log.Fatal(err)
+func TestDB_Setup_RestoreTs(t *testing.T) {
+	dir := t.TempDir()
+	generateTestData(dir)
+	db := OpenTestDB(dir)
+	db.Setup()
+	if db.tsGenerator != 1 {
+		t.Errorf("ts should be restored from wal: %v", db.tsGenerator)
+	}
+	tx := NewTx(db)
+	if tx.ts != 2 {
+		t.Errorf("wrong ts: %v", tx.ts)
+	}
+	if err := tx.Update("test4", "value44"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.DestructTx()
+	db.close()
+
+	// db-file (ts 1) + wal (ts 2)
+	db = OpenTestDB(dir)
+	defer db.close()
+	db.Setup()
+	if db.tsGenerator != 2 {
+		t.Errorf("ts should be restored: %v", db.tsGenerator)
+	}
+	for key, ts := range map[string]uint64{"test1": 0, "test4": 2} {
+		v, exist := db.index.Load(key)
+		if !exist || v.(*Record).last.wTs != ts {
+			t.Errorf("wrong ts of %v", key)
+		}
+	}
+	if tx := NewTx(db); tx.ts != 3 {
+		t.Errorf("wrong ts: %v", tx.ts)
 	}
-	defer walFile.Close()
-	dbFile, err := os.Create(TestDBFileName)
+}
+
+// generateTestData writes the test db-file and wal to dir
+func generateTestData(dir string) {
+	dbFile, err := os.Create(filepath.Join(dir, TestDBFileName))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer dbFile.Close()
 
 	// test data -> db-file
+	writer, err := newSnapshotWriter(dbFile, &snapshotHeader{}, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
 	for i := 1; i < 4; i++ {
-		line := fmt.Sprintf("test%v value%v\n", i, i)
-		_, err = dbFile.WriteString(line)
-		if err != nil {
+		if err := writer.add(fmt.Sprintf("test%v", i), fmt.Sprintf("value%v", i), 0); err != nil {
 			log.Fatal(err)
 		}
 	}
+	if err := writer.close(); err != nil {
+		log.Fatal(err)
+	}
 	if err := dbFile.Sync(); err != nil {
 		log.Println("cannot sync db-file")
 	}
@@ -114,47 +160,31 @@ func generateTestData() {
 	testWriteSet["test2"] = append(testWriteSet["test2"], &Operation{DELETE, &Version{"test2", "", 0, 0, nil, true}})
 
 	// write-set -> wal-file
-	buf := make([]byte, 4096)
-	idx := uint(0)
-	for _, operations := range testWriteSet {
-		for _, op := range operations {
-			checksum := crc32.ChecksumIEEE([]byte(op.version.key))
-
-			// serialize data
-			size := serialize(buf, idx, op, checksum)
-			idx += size
-		}
-	}
-	if _, err := walFile.Write(buf); err != nil {
-		log.Fatal(err)
-	}
-	if err := walFile.Sync(); err != nil {
-		log.Println("cannot sync wal-file")
+	var operations []*Operation
+	for _, ops := range testWriteSet {
+		operations = append(operations, ops...)
 	}
+	buf := new(bytes.Buffer)
+	tw := &testWalWriter{w: buf}
+	tw.writeTx(1, operations...)
+	writeTestWal(dir, buf.Bytes())
 }
 
-func NewTestDB() *DB {
-	walFile, err := os.OpenFile(TestWALFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatal(err)
-	}
-	dbFile, err := os.OpenFile(TestDBFileName, os.O_CREATE|os.O_RDONLY, 0666)
-	if err != nil {
-		log.Fatal(err)
-	}
+// OpenTestDB opens the test db in dir as it is
+func OpenTestDB(dir string) *DB {
+	return NewDB(filepath.Join(dir, TestWALFileName), filepath.Join(dir, TestDBFileName), Options{})
+}
 
-	return &DB{
-		walMu:       sync.Mutex{},
-		wALFile:     walFile,
-		dBFile:      dbFile,
-		index:       sync.Map{},
-		tsGenerator: 0,
-		aliveTx:     AliveTx{},
-	}
+// newTempDB opens an empty db in a temp dir, which is closed after the test
+func newTempDB(t *testing.T, opts Options) *DB {
+	dir := t.TempDir()
+	db := NewDB(filepath.Join(dir, "seccampdb.log"), filepath.Join(dir, "seccampdb.db"), opts)
+	t.Cleanup(db.close)
+	return db
 }
 
 func TestDB_versionGC(t *testing.T) {
-	db := NewTestDB()
+	db := newTempDB(t, Options{})
 	v1 := &Version{
 		key:     "key1",
 		value:   "value1",
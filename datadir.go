@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// data directory
+// <data-dir>/seccampdb.db, seccampdb.log.<lsn>, tmp.db, LOCK, VERSION
+const (
+	LockFileName    = "LOCK"
+	VersionFileName = "VERSION"
+	FormatVersion   = 3 // db-file と wal の format が変わったら上げる
+)
+
+// format version
+// 1: checksum 付きの db-file と wal segment
+// 2: 暗号化された db-file (snapshot version 3) と wal segment (segment version 2)
+// 3: 圧縮された db-file の block と wal record (header の flags の codec)
+// 古い version の directory も読めるので、server が開くと今の version にする
+// (古い binary が新しい format の file を壊れた file として捨てないようにする)
+
+var (
+	errLocked        = errors.New("data directory is used by another process")
+	errFormatVersion = errors.New("unsupported format version")
+)
+
+// DataDir is the directory holding every file of a DB. It is locked while it
+// is open, so that two processes never write the same files.
+type DataDir struct {
+	path string
+	lock *os.File
+}
+
+// OpenDataDir creates path if needed, locks it and checks its format
+// version. A directory without a version file (new, or written before the
+// version file was added) gets the current version.
+func OpenDataDir(path string) (*DataDir, error) {
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(path, LockFileName))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	d := &DataDir{path: path, lock: lock}
+	if err := d.checkVersion(true); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// DBFileName returns the path of db-file.
+func (d *DataDir) DBFileName() string {
+	return filepath.Join(d.path, DBFileName)
+}
+
+// WALFileName returns the path prefix of the wal segments.
+func (d *DataDir) WALFileName() string {
+	return filepath.Join(d.path, WALFileName)
+}
+
+// OpenDB returns the DB of the files in the directory. The directory is
+// closed (unlocked) when the DB is closed or shut down.
+func (d *DataDir) OpenDB(opts Options) *DB {
+	db := NewDB(d.WALFileName(), d.DBFileName(), opts)
+	db.dataDir = d
+	return db
+}
+
+// Close unlocks the directory.
+func (d *DataDir) Close() error {
+	if d.lock == nil {
+		return nil
+	}
+	err := unlockFile(d.lock)
+	d.lock = nil
+	return err
+}
+
+// checkVersion returns an error if the files are in a format this binary does
+// not know. If create, a missing or older version file is (re)written.
+func (d *DataDir) checkVersion(create bool) error {
+	name := filepath.Join(d.path, VersionFileName)
+	fs := osFS{}
+	buf, err := readFile(fs, name)
+	if os.IsNotExist(err) {
+		if !create {
+			return nil
+		}
+		return writeVersion(fs, d.path)
+	}
+	if err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return fmt.Errorf("%v: broken version file: %q", name, buf)
+	}
+	if version < 1 || version > FormatVersion {
+		return fmt.Errorf("%v: %w %v (this binary supports up to %v)", d.path, errFormatVersion, version, FormatVersion)
+	}
+	if version < FormatVersion && create {
+		return writeVersion(fs, d.path)
+	}
+	return nil
+}
+
+func writeVersion(fs FileSystem, dir string) error {
+	tmpFileName := filepath.Join(dir, VersionFileName+".tmp")
+	fs.Remove(tmpFileName)
+	if err := writeFile(fs, tmpFileName, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, FormatVersion)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmpFileName, filepath.Join(dir, VersionFileName)); err != nil {
+		return err
+	}
+	return fs.SyncDir(dir)
+}
+
+// checkDataDir checks the format version of a data directory without locking
+// it, for the tools which only read it.
+func checkDataDir(path string) error {
+	return (&DataDir{path: path}).checkVersion(false)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenDataDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	dir, err := OpenDataDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.DBFileName() != filepath.Join(path, DBFileName) || dir.WALFileName() != filepath.Join(path, WALFileName) {
+		t.Errorf("wrong file names: %v, %v", dir.DBFileName(), dir.WALFileName())
+	}
+
+	// 2 つ目の server は開けない
+	if _, err := OpenDataDir(path); !errors.Is(err, errLocked) {
+		t.Errorf("should be locked: %v", err)
+	}
+	if err := dir.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err = OpenDataDir(path)
+	if err != nil {
+		t.Fatalf("should be unlocked: %v", err)
+	}
+	dir.Close()
+
+	buf, err := ioutil.ReadFile(filepath.Join(path, VersionFileName))
+	if err != nil || string(buf) != fmt.Sprintln(FormatVersion) {
+		t.Errorf("wrong version file: %q, %v", buf, err)
+	}
+}
+
+func TestDataDir_Shutdown(t *testing.T) {
+	path := t.TempDir()
+	dir, err := OpenDataDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dir.OpenDB(Options{})
+	db.Setup()
+	tx := NewTx(db)
+	tx.Insert("key", "value")
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.DestructTx()
+	if err := db.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// shutdown の後は次の server が開ける
+	dir, err = OpenDataDir(path)
+	if err != nil {
+		t.Fatalf("should be unlocked after shutdown: %v", err)
+	}
+	db = dir.OpenDB(Options{})
+	db.Setup()
+	defer db.close()
+	if _, exist := db.index.Load("key"); !exist {
+		t.Error("committed tx is lost")
+	}
+}
+
+func TestOpenDataDir_Version(t *testing.T) {
+	path := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(path, VersionFileName), []byte(fmt.Sprintln(FormatVersion+1)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDataDir(path); !errors.Is(err, errFormatVersion) {
+		t.Errorf("should refuse a newer format: %v", err)
+	}
+	if err := checkDataDir(path); !errors.Is(err, errFormatVersion) {
+		t.Errorf("should refuse a newer format: %v", err)
+	}
+	// lock は残らない
+	// 古い version は読めて、server が開くと今の version になる
+	if err := ioutil.WriteFile(filepath.Join(path, VersionFileName), []byte("1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDataDir(path); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := OpenDataDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir.Close()
+	buf, err := ioutil.ReadFile(filepath.Join(path, VersionFileName))
+	if err != nil || string(buf) != fmt.Sprintln(FormatVersion) {
+		t.Errorf("version file is not upgraded: %q, %v", buf, err)
+	}
+}
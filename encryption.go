@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// encryption at rest
+// snapshot block と wal record の中身を AES-GCM で暗号化する
+// sealed: | nonce (12) | ciphertext | tag (16) |
+// file の header には鍵の id (鍵の SHA-256 の先頭 8 byte) を書く
+const (
+	KeyEnv     = "SECCAMPDB_KEY"      // hex encoded key
+	OldKeysEnv = "SECCAMPDB_OLD_KEYS" // comma separated hex encoded keys
+	nonceSize  = 12
+	sealedSize = nonceSize + 16 // sealed の増える分
+)
+
+var (
+	errNoKey     = errors.New("encrypted, but no key is given (-key-file or " + KeyEnv + ")")
+	errWrongKey  = errors.New("encrypted with another key")
+	errKeyFormat = errors.New("key must be 16, 24 or 32 bytes in hex")
+)
+
+type cipherKey struct {
+	id   uint64
+	aead cipher.AEAD
+}
+
+func newCipherKey(key []byte) (*cipherKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errKeyFormat
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &cipherKey{id: binary.BigEndian.Uint64(sum[:8]), aead: aead}, nil
+}
+
+// seal encrypts plain. aad is authenticated but not encrypted.
+func (k *cipherKey) seal(plain, aad []byte) []byte {
+	buf := make([]byte, nonceSize, sealedSize+len(plain))
+	if _, err := rand.Read(buf); err != nil {
+		panic(err) // crypto/rand は失敗しない
+	}
+	return k.aead.Seal(buf, buf, plain, aad)
+}
+
+// open decrypts what seal returned. It fails if sealed or aad were modified.
+func (k *cipherKey) open(sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < sealedSize {
+		return nil, errChecksum
+	}
+	plain, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], aad)
+	if err != nil {
+		return nil, errChecksum
+	}
+	return plain, nil
+}
+
+// sealRecord encrypts the body of an encoded wal record whose lsn is set. The
+// size, lsn and type stay readable, so resync works on sealed records, and
+// the lsn and type are authenticated, so a record cannot be moved to another
+// lsn (setLSN must not be used after it).
+func (k *cipherKey) sealRecord(buf []byte) []byte {
+	typ := buf[12]
+	return withBody(buf, typ, k.seal(buf[recordHeaderSize:len(buf)-checksumSize], buf[4:recordHeaderSize]))
+}
+
+// openRecord returns the encoded wal record sealed by sealRecord.
+func (k *cipherKey) openRecord(sealed []byte) ([]byte, error) {
+	typ := sealed[12]
+	body, err := k.open(sealed[recordHeaderSize:len(sealed)-checksumSize], sealed[4:recordHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	return withBody(sealed, typ, body), nil
+}
+
+// Keyring is the key new files are encrypted with, and the old keys which
+// are only used to read the files written before a key rotation. A nil
+// Keyring disables encryption.
+type Keyring struct {
+	current *cipherKey
+	keys    map[uint64]*cipherKey
+}
+
+// NewKeyring returns a Keyring encrypting with current (nil to write files in
+// plain text) and decrypting with current and old.
+func NewKeyring(current []byte, old ...[]byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[uint64]*cipherKey)}
+	for i, key := range append([][]byte{current}, old...) {
+		if i == 0 && key == nil {
+			continue
+		}
+		c, err := newCipherKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			k.current = c
+		}
+		k.keys[c.id] = c
+	}
+	return k, nil
+}
+
+// encryptKey returns the key new files are encrypted with, or nil.
+func (k *Keyring) encryptKey() *cipherKey {
+	if k == nil {
+		return nil
+	}
+	return k.current
+}
+
+// get returns the key whose id is id.
+func (k *Keyring) get(id uint64) (*cipherKey, error) {
+	if k == nil || len(k.keys) == 0 {
+		return nil, errNoKey
+	}
+	key, exist := k.keys[id]
+	if !exist {
+		return nil, fmt.Errorf("%w (key id %016x), give it with -old-key-file to rotate the key", errWrongKey, id)
+	}
+	return key, nil
+}
+
+func isKeyError(err error) bool {
+	return errors.Is(err, errNoKey) || errors.Is(err, errWrongKey)
+}
+
+// parseKey decodes a hex encoded key.
+func parseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errKeyFormat
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, errKeyFormat
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKey(string(buf))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return key, nil
+}
+
+// keyFlags are the flags of the keys, shared by the server and the tools.
+type keyFlags struct {
+	keyFile     *string
+	oldKeyFiles *string
+}
+
+func addKeyFlags(flags *flag.FlagSet) *keyFlags {
+	return &keyFlags{
+		keyFile:     flags.String("key-file", "", "file of the hex encoded AES key to encrypt the files with (or "+KeyEnv+")"),
+		oldKeyFiles: flags.String("old-key-file", "", "comma separated files of old keys, to read files written before a key rotation (or "+OldKeysEnv+")"),
+	}
+}
+
+// load returns the Keyring given by the flags or the environment variables,
+// or nil if no key is given.
+func (f *keyFlags) load() (*Keyring, error) {
+	var current []byte
+	var err error
+	if *f.keyFile != "" {
+		if current, err = readKeyFile(*f.keyFile); err != nil {
+			return nil, err
+		}
+	} else if s := os.Getenv(KeyEnv); s != "" {
+		if current, err = parseKey(s); err != nil {
+			return nil, fmt.Errorf("%v: %w", KeyEnv, err)
+		}
+	}
+
+	var old [][]byte
+	if *f.oldKeyFiles != "" {
+		for _, path := range strings.Split(*f.oldKeyFiles, ",") {
+			key, err := readKeyFile(path)
+			if err != nil {
+				return nil, err
+			}
+			old = append(old, key)
+		}
+	} else if s := os.Getenv(OldKeysEnv); s != "" {
+		for _, field := range strings.Split(s, ",") {
+			key, err := parseKey(field)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", OldKeysEnv, err)
+			}
+			old = append(old, key)
+		}
+	}
+
+	if current == nil && len(old) == 0 {
+		return nil, nil
+	}
+	return NewKeyring(current, old...)
+}
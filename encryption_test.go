@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func testKeyring(t *testing.T, current []byte, old ...[]byte) *Keyring {
+	t.Helper()
+	keys, err := NewKeyring(current, old...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// openEncryptedDB runs Setup with keys and returns the value of key.
+func openEncryptedDB(fs FileSystem, keys *Keyring, key string) (string, error) {
+	db := NewDB("/db/seccampdb.log", "/db/seccampdb.db", Options{FS: fs, Keys: keys})
+	defer db.close()
+	if err := db.setup(); err != nil {
+		return "", err
+	}
+	record, exist := db.index.Load(key)
+	if !exist {
+		return "", errors.New("not found")
+	}
+	return record.(*Record).last.value, nil
+}
+
+func TestDB_Encryption(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	mem := newMemFS()
+	mem.MkdirAll("/db", 0777)
+
+	// wal に書いて checkpoint せずに止める
+	db := NewDB("/db/seccampdb.log", "/db/seccampdb.db", Options{FS: mem, Keys: testKeyring(t, key1)})
+	if err := db.setup(); err != nil {
+		t.Fatal(err)
+	}
+	tx := NewTx(db)
+	tx.Insert("key", "plaintext-value")
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.DestructTx()
+	db.close()
+
+	// 平文はどの file にも無い
+	contains := func() bool {
+		for _, inode := range mem.files {
+			if bytes.Contains(inode.data, []byte("plaintext-value")) {
+				return true
+			}
+		}
+		return false
+	}
+	if contains() {
+		t.Fatal("the wal is not encrypted")
+	}
+
+	// wal -> db-file
+	if value, err := openEncryptedDB(mem, testKeyring(t, key1), "key"); err != nil || value != "plaintext-value" {
+		t.Fatalf("got %q, %v", value, err)
+	}
+	if contains() {
+		t.Fatal("db-file is not encrypted")
+	}
+
+	if _, err := openEncryptedDB(mem, nil, "key"); !errors.Is(err, errNoKey) {
+		t.Errorf("should fail without the key: %v", err)
+	}
+	if _, err := openEncryptedDB(mem, testKeyring(t, key2), "key"); !errors.Is(err, errWrongKey) {
+		t.Errorf("should fail with a wrong key: %v", err)
+	}
+
+	// key rotation: 古い鍵で読み、新しい鍵で書き直す
+	if value, err := openEncryptedDB(mem, testKeyring(t, key2, key1), "key"); err != nil || value != "plaintext-value" {
+		t.Fatalf("got %q, %v", value, err)
+	}
+	if value, err := openEncryptedDB(mem, testKeyring(t, key2), "key"); err != nil || value != "plaintext-value" {
+		t.Fatalf("should be rotated: got %q, %v", value, err)
+	}
+	if _, err := openEncryptedDB(mem, testKeyring(t, key1), "key"); !errors.Is(err, errWrongKey) {
+		t.Errorf("the old key should not be used: %v", err)
+	}
+}
+
+func TestWALReader_Encrypted(t *testing.T) {
+	keys := testKeyring(t, bytes.Repeat([]byte{1}, 16))
+	key := keys.encryptKey()
+	buf, err := encodeRecord(&walRecord{typ: recBegin, ts: 3, opCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLSN(buf, 7)
+	sealed := key.sealRecord(buf)
+
+	reader, err := newWALReader(bytes.NewReader(sealed), walFormat{key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := reader.next()
+	if err != nil || rec.lsn != 7 || rec.typ != recBegin || rec.ts != 3 || rec.opCount != 1 {
+		t.Fatalf("got %+v, %v", rec, err)
+	}
+
+	// 書き換えられた record や別の lsn に移された record は checksum が合っていても読まない
+	for _, modify := range []func(buf []byte){
+		func(buf []byte) { buf[recordHeaderSize] ^= 1; setLSN(buf, 7) },
+		func(buf []byte) { setLSN(buf, 8) },
+	} {
+		modified := append([]byte(nil), sealed...)
+		modify(modified)
+		reader, err = newWALReader(bytes.NewReader(modified), walFormat{key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.next(); err != errChecksum {
+			t.Errorf("should detect the modification: %v", err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+var errInjected = errors.New("injected fault")
+
+// faultOp is an operation of faultFS which changes the file system.
+type faultOp struct {
+	n    int    // 0, 1, 2, ... in the order of the operations
+	kind string // create, write, sync, rename, remove, mkdir, syncdir
+	name string
+}
+
+// faultFS wraps a FileSystem and injects faults for tests. fault is called
+// for every operation which changes the file system and returns the error to
+// fail it with, or nil. A failed write writes a half of its data, like a
+// torn write or a full disk. Reads never fail.
+type faultFS struct {
+	FileSystem
+	mu    sync.Mutex
+	ops   int
+	fault func(op *faultOp) error
+}
+
+func newFaultFS(fs FileSystem, fault func(op *faultOp) error) *faultFS {
+	return &faultFS{FileSystem: fs, fault: fault}
+}
+
+// crashAt fails the n-th operation and every operation after it, as if the
+// process was killed there.
+func crashAt(n int) func(op *faultOp) error {
+	return func(op *faultOp) error {
+		if op.n >= n {
+			return errInjected
+		}
+		return nil
+	}
+}
+
+// failKind fails every operation of kind with err from the n-th operation,
+// e.g. failKind("sync", 0, errInjected) or failKind("write", 10, syscall.ENOSPC).
+func failKind(kind string, n int, err error) func(op *faultOp) error {
+	return func(op *faultOp) error {
+		if op.kind == kind && op.n >= n {
+			return err
+		}
+		return nil
+	}
+}
+
+// count returns the number of the operations so far.
+func (fs *faultFS) count() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.ops
+}
+
+func (fs *faultFS) inject(kind, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	op := &faultOp{n: fs.ops, kind: kind, name: name}
+	fs.ops++
+	if fs.fault == nil {
+		return nil
+	}
+	if err := fs.fault(op); err != nil {
+		return &os.PathError{Op: kind, Path: name, Err: err}
+	}
+	return nil
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if _, err := fs.Stat(name); flag&os.O_CREATE != 0 && os.IsNotExist(err) {
+		if err := fs.inject("create", name); err != nil {
+			return nil, err
+		}
+	}
+	file, err := fs.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: fs, name: name}, nil
+}
+
+func (fs *faultFS) Remove(name string) error {
+	if err := fs.inject("remove", name); err != nil {
+		return err
+	}
+	return fs.FileSystem.Remove(name)
+}
+
+func (fs *faultFS) Rename(oldpath, newpath string) error {
+	if err := fs.inject("rename", newpath); err != nil {
+		return err
+	}
+	return fs.FileSystem.Rename(oldpath, newpath)
+}
+
+func (fs *faultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := fs.inject("mkdir", path); err != nil {
+		return err
+	}
+	return fs.FileSystem.MkdirAll(path, perm)
+}
+
+func (fs *faultFS) SyncDir(dir string) error {
+	if err := fs.inject("syncdir", dir); err != nil {
+		return err
+	}
+	return fs.FileSystem.SyncDir(dir)
+}
+
+type faultFile struct {
+	File
+	fs   *faultFS
+	name string
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.inject("write", f.name); err != nil {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.inject("sync", f.name); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
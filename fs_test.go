@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMemFS_Crash(t *testing.T) {
+	fs := newMemFS()
+	write := func(name, data string, sync bool) {
+		file, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if sync {
+			if err := file.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write("/db/synced", "abcd", true)
+	write("/db/synced", "efgh", false)
+	write("/db/renamed", "1234", true)
+	if err := fs.SyncDir("/db"); err != nil {
+		t.Fatal(err)
+	}
+	write("/db/new", "xyz", true) // directory が sync されていない
+	if err := fs.Rename("/db/renamed", "/db/renamed2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		torn bool
+		want map[string]string
+	}{
+		{false, map[string]string{"/db/synced": "abcd", "/db/renamed": "1234"}},
+		{true, map[string]string{"/db/synced": "abcdef", "/db/renamed": "1234"}},
+	}
+	for _, tt := range tests {
+		crashed := fs.Crash(tt.torn)
+		got := make(map[string]string)
+		infos, err := crashed.ReadDir("/db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			buf, err := readFile(crashed, "/db/"+info.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got["/db/"+info.Name()] = string(buf)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("torn=%v: got %v, want %v", tt.torn, got, tt.want)
+		}
+	}
+}
+
+// crashWorkload runs txs, checkpoints and a restart on fs, which starts to
+// fail at some point. It returns the keys and values of the acked txs.
+func crashWorkload(fs *faultFS, fault func(op *faultOp) error) map[string]string {
+	opts := Options{FS: fs, SegmentSize: 128}
+	fs.MkdirAll("/db", 0777)
+	db := NewDB("/db/seccampdb.log", "/db/seccampdb.db", opts)
+	fs.fault = fault
+	defer func() { db.close() }()
+	acked := make(map[string]string)
+	if err := db.setup(); err != nil {
+		return acked
+	}
+
+	for i := 0; i < 12; i++ {
+		switch i {
+		case 4, 9:
+			db.checkpoint(time.Second)
+		case 7: // 再起動
+			db.close()
+			db = NewDB("/db/seccampdb.log", "/db/seccampdb.db", opts)
+			if err := db.setup(); err != nil {
+				return acked
+			}
+		}
+
+		// 消した key は二度と使わない
+		tx := NewTx(db)
+		writes := map[string]string{fmt.Sprintf("key%v", i): fmt.Sprintf("value%v", i)}
+		err := tx.Insert(fmt.Sprintf("key%v", i), fmt.Sprintf("value%v", i))
+		if i > 0 && err == nil {
+			key := fmt.Sprintf("key%v", i-1)
+			writes[key] = fmt.Sprintf("value%v-%v", i-1, i)
+			err = tx.Update(key, writes[key])
+		}
+		if i%3 == 2 && err == nil {
+			key := fmt.Sprintf("key%v", i-2)
+			writes[key] = ""
+			err = tx.Delete(key)
+		}
+		if err == nil {
+			_, err = tx.Commit()
+		}
+		tx.DestructTx()
+		if err != nil { // read-only になった
+			continue
+		}
+		for key, value := range writes {
+			if value == "" {
+				delete(acked, key)
+			} else {
+				acked[key] = value
+			}
+		}
+	}
+	return acked
+}
+
+func recoveredData(t *testing.T, fs FileSystem) map[string]string {
+	t.Helper()
+	db := NewDB("/db/seccampdb.log", "/db/seccampdb.db", Options{FS: fs})
+	defer db.close()
+	if err := db.setup(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	data := make(map[string]string)
+	db.index.Range(func(k, v interface{}) bool {
+		if last := v.(*Record).last; !last.deleted {
+			data[k.(string)] = last.value
+		}
+		return true
+	})
+	return data
+}
+
+// 全ての書き込み (write, fsync, create, rename, remove) の所で crash させ、
+// Setup が ack された tx だけを復旧することを確かめる
+func TestDB_Setup_CrashAtEveryWrite(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// 最後まで動かして書き込みの数を数える
+	fs := newFaultFS(newMemFS(), nil)
+	want := crashWorkload(fs, nil)
+	if len(want) == 0 {
+		t.Fatal("no tx is committed")
+	}
+	if got := recoveredData(t, fs.FileSystem.(*memFS).Crash(false)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	n := fs.count()
+
+	for i := 0; i < n; i++ {
+		for _, torn := range []bool{false, true} {
+			mem := newMemFS()
+			acked := crashWorkload(newFaultFS(mem, nil), crashAt(i))
+			crashed := mem.Crash(torn)
+			if got := recoveredData(t, crashed); !reflect.DeepEqual(got, acked) {
+				t.Errorf("crash at %v (torn=%v): got %v, want %v\nfiles:\n%v", i, torn, got, acked, crashed)
+			}
+
+			// 復旧の後も書き込めて、もう一度 crash しても失われない
+			db := NewDB("/db/seccampdb.log", "/db/seccampdb.db", Options{FS: crashed, SegmentSize: 128})
+			if err := db.setup(); err != nil {
+				t.Fatal(err)
+			}
+			tx := NewTx(db)
+			tx.Insert("after", "value")
+			if _, err := tx.Commit(); err != nil {
+				t.Errorf("crash at %v (torn=%v): cannot commit after recovery: %v", i, torn, err)
+			}
+			tx.DestructTx()
+			db.close()
+			acked["after"] = "value"
+			if got := recoveredData(t, crashed.Crash(torn)); !reflect.DeepEqual(got, acked) {
+				t.Errorf("crash at %v (torn=%v) and after recovery: got %v, want %v", i, torn, got, acked)
+			}
+		}
+	}
+}
+
+func TestDB_DiskFull(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	mem := newMemFS()
+	fs := newFaultFS(mem, nil)
+	fs.MkdirAll("/db", 0777)
+	db := NewDB("/db/seccampdb.log", "/db/seccampdb.db", Options{FS: fs})
+	if err := db.setup(); err != nil {
+		t.Fatal(err)
+	}
+	tx := NewTx(db)
+	tx.Insert("key1", "value1")
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.DestructTx()
+
+	fs.fault = failKind("write", fs.count(), syscall.ENOSPC)
+	tx = NewTx(db)
+	tx.Insert("key2", "value2")
+	if _, err := tx.Commit(); err == nil {
+		t.Error("should fail on a full disk")
+	}
+	tx.DestructTx()
+	if db.Degraded() == nil {
+		t.Error("should be read-only")
+	}
+	db.close()
+
+	if got := recoveredData(t, mem.Crash(true)); !reflect.DeepEqual(got, map[string]string{"key1": "value1"}) {
+		t.Errorf("wrong data after recovery: %v", got)
+	}
+}
+
+func TestDB_BackgroundSyncError(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	mem := newMemFS()
+	fs := newFaultFS(mem, nil)
+	fs.MkdirAll("/db", 0777)
+	db := NewDB("/db/seccampdb.log", "/db/seccampdb.db", Options{FS: fs, Durability: BackgroundSync, SyncInterval: time.Millisecond})
+	if err := db.setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	// background の tx は fsync の前に返るので、失敗は syncer が見つける
+	fs.fault = failKind("sync", fs.count(), errInjected)
+	tx := NewTx(db)
+	tx.Insert("key1", "value1")
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.DestructTx()
+	deadline := time.Now().Add(time.Second)
+	for db.Degraded() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !errors.Is(db.Degraded(), errReadOnly) {
+		t.Fatalf("should be read-only after a failed fsync: %v", db.Degraded())
+	}
+	if db.DurableLSN() != 0 {
+		t.Errorf("records are durable after a failed fsync: %v", db.DurableLSN())
+	}
+	tx = NewTx(db)
+	defer tx.DestructTx()
+	if err := tx.Insert("key2", "value2"); !errors.Is(err, errReadOnly) {
+		t.Errorf("write should fail: %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultGroupCommitSize = 128
+	DefaultSyncInterval    = 10 * time.Millisecond
+)
+
+var (
+	errWALClosed = errors.New("wal is closed")
+	errReadOnly  = errors.New("database is read-only")
+)
+
+// Durability decides when the wal records of a tx are fsynced.
+type Durability int
+
+const (
+	// SyncOnCommit fsyncs the wal before commit returns.
+	SyncOnCommit Durability = iota
+	// BackgroundSync returns after the write and fsyncs the wal every
+	// SyncInterval. A crash may lose the txs of the last interval.
+	BackgroundSync
+	// NoSync leaves fsync to the OS (and to checkpoints and shutdown).
+	NoSync
+)
+
+func ParseDurability(s string) (Durability, error) {
+	switch s {
+	case "sync":
+		return SyncOnCommit, nil
+	case "background":
+		return BackgroundSync, nil
+	case "nosync":
+		return NoSync, nil
+	}
+	return 0, fmt.Errorf("unknown durability: %v", s)
+}
+
+func (d Durability) String() string {
+	switch d {
+	case SyncOnCommit:
+		return "sync"
+	case BackgroundSync:
+		return "background"
+	case NoSync:
+		return "nosync"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// groupCommitter batches the WAL records of concurrent committers so that
+// they are written by a single write and made durable by a single fsync.
+// It also assigns the lsn of every record in the order they are written.
+type groupCommitter struct {
+	log        *segmentedLog
+	requests   chan *walRequest
+	maxBatch   int           // max number of txs in one batch
+	maxWait    time.Duration // how long to wait for more txs after the first one
+	batches    uint64        // number of write+fsync (for stats)
+	writtenLSN uint64        // atomic, written to the OS
+	durableLSN uint64        // atomic, fsynced
+	syncs      uint64        // number of fsync (for stats)
+
+	backgroundLSN uint64 // atomic, the last record of a BackgroundSync tx
+
+	mu      sync.Mutex // queue が一杯だと持ったまま待つので flusher は取らない
+	nextLSN uint64
+	closed  bool
+	done    chan struct{}
+
+	failMu sync.Mutex
+	failed error // wal に書けなくなった理由 (以後の commit は全て失敗する)
+}
+
+type walRequest struct {
+	records    [][]byte
+	firstLSN   uint64
+	lsn        uint64 // lsn of the last record
+	sync       bool   // fsync before done
+	background bool   // fsync by the syncer
+	done       chan error
+}
+
+// newGroupCommitter starts the flusher and the background syncer, which
+// fsyncs the records of BackgroundSync txs every syncInterval.
+func newGroupCommitter(log *segmentedLog, maxBatch int, maxWait, syncInterval time.Duration) *groupCommitter {
+	if maxBatch <= 0 {
+		maxBatch = DefaultGroupCommitSize
+	}
+	if syncInterval <= 0 {
+		syncInterval = DefaultSyncInterval
+	}
+	g := &groupCommitter{
+		log:      log,
+		requests: make(chan *walRequest, maxBatch),
+		maxBatch: maxBatch,
+		maxWait:  maxWait,
+		nextLSN:  1,
+		done:     make(chan struct{}),
+	}
+	go g.run()
+	// server の設定が sync でも tx が background を選べるので常に動かす
+	go g.runSyncer(syncInterval)
+	return g
+}
+
+// commit assigns lsns to the encoded (and compressed) records of a tx, seals
+// them, enqueues them and waits until they are written (and fsynced if
+// SyncOnCommit). It returns the lsn of the last record.
+func (g *groupCommitter) commit(records [][]byte, durability Durability) (uint64, error) {
+	req := &walRequest{
+		records:    records,
+		sync:       durability == SyncOnCommit,
+		background: durability == BackgroundSync,
+		done:       make(chan error, 1),
+	}
+
+	// lsn の順に queue に入れる
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return 0, errWALClosed
+	}
+	if err := g.err(); err != nil {
+		g.mu.Unlock()
+		return 0, err
+	}
+	req.firstLSN = g.nextLSN
+	for i, rec := range records {
+		setLSN(rec, g.nextLSN)
+		// lsn も認証するので暗号化は lsn を付けた後
+		records[i] = g.log.format.seal(rec)
+		g.nextLSN++
+	}
+	req.lsn = g.nextLSN - 1
+	g.requests <- req
+	g.mu.Unlock()
+
+	if err := <-req.done; err != nil {
+		return 0, err
+	}
+	return req.lsn, nil
+}
+
+// durable returns the lsn up to which all records are durable.
+func (g *groupCommitter) durable() uint64 {
+	return atomic.LoadUint64(&g.durableLSN)
+}
+
+// written returns the lsn up to which all records are written to the OS.
+func (g *groupCommitter) written() uint64 {
+	return atomic.LoadUint64(&g.writtenLSN)
+}
+
+// next returns the lsn the next record will get.
+func (g *groupCommitter) next() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.nextLSN
+}
+
+// resetLSN makes the next record follow lsn, which is already durable.
+// It must be called before any commit (e.g. after crash recovery).
+func (g *groupCommitter) resetLSN(lsn uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.nextLSN = lsn + 1
+	atomic.StoreUint64(&g.writtenLSN, lsn)
+	atomic.StoreUint64(&g.durableLSN, lsn)
+	g.log.reset(lsn)
+}
+
+// close flushes and fsyncs the pending requests and stops the flusher.
+func (g *groupCommitter) close() {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return
+	}
+	g.closed = true
+	close(g.requests)
+	g.mu.Unlock()
+	<-g.done
+	if err := g.sync(); err != nil {
+		log.Println("cannot sync wal:", err)
+	}
+}
+
+func (g *groupCommitter) run() {
+	defer close(g.done)
+	for {
+		req, ok := <-g.requests
+		if !ok {
+			return
+		}
+		batch := g.collect([]*walRequest{req})
+
+		err := g.flush(batch)
+		if err != nil {
+			err = g.fail(err)
+		}
+		for _, req := range batch {
+			req.done <- err
+		}
+	}
+}
+
+// err returns why the wal is read-only, or nil.
+func (g *groupCommitter) err() error {
+	g.failMu.Lock()
+	defer g.failMu.Unlock()
+	return g.failed
+}
+
+// fail makes the wal read-only. After a failed write or fsync the state of
+// the segment is unknown, so no record is written after it.
+func (g *groupCommitter) fail(err error) error {
+	g.failMu.Lock()
+	defer g.failMu.Unlock()
+	if g.failed == nil {
+		g.failed = fmt.Errorf("%w: cannot write wal: %v", errReadOnly, err)
+		log.Println(g.failed)
+	}
+	return g.failed
+}
+
+// sync makes the written records durable. A failed fsync makes the wal
+// read-only, also when it is done by the syncer, close or a checkpoint.
+func (g *groupCommitter) sync() error {
+	// fsync が一度失敗すると、次の fsync が成功しても前の write が永続化されたか分からない
+	if err := g.err(); err != nil {
+		return err
+	}
+	written := g.written()
+	if written <= g.durable() {
+		return nil
+	}
+	if err := g.log.sync(); err != nil {
+		return g.fail(err)
+	}
+	atomic.AddUint64(&g.syncs, 1)
+	// flusher と競合しても小さい lsn で上書きしない
+	for {
+		durable := g.durable()
+		if written <= durable || atomic.CompareAndSwapUint64(&g.durableLSN, durable, written) {
+			return nil
+		}
+	}
+}
+
+// runSyncer fsyncs the records of BackgroundSync txs every interval until the
+// committer is closed. The records of NoSync txs are left to the OS.
+func (g *groupCommitter) runSyncer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			if atomic.LoadUint64(&g.backgroundLSN) <= g.durable() {
+				continue
+			}
+			if err := g.sync(); err != nil {
+				log.Println("cannot sync wal:", err)
+			}
+		}
+	}
+}
+
+// collect adds queued requests to batch, waiting up to maxWait for more.
+func (g *groupCommitter) collect(batch []*walRequest) []*walRequest {
+	var timeout <-chan time.Time
+	if g.maxWait > 0 {
+		timer := time.NewTimer(g.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(batch) < g.maxBatch {
+		if timeout == nil {
+			select {
+			case req, ok := <-g.requests:
+				if !ok {
+					return batch
+				}
+				batch = append(batch, req)
+			default:
+				return batch
+			}
+			continue
+		}
+		select {
+		case req, ok := <-g.requests:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, req)
+		case <-timeout:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (g *groupCommitter) flush(batch []*walRequest) error {
+	if err := g.err(); err != nil {
+		return err
+	}
+	size := 0
+	for _, req := range batch {
+		for _, rec := range req.records {
+			size += len(rec)
+		}
+	}
+	buf := make([]byte, 0, size)
+	for _, req := range batch {
+		for _, rec := range req.records {
+			buf = append(buf, rec...)
+		}
+	}
+
+	g.batches++
+	if err := g.log.write(buf, batch[0].firstLSN, batch[len(batch)-1].lsn); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&g.writtenLSN, batch[len(batch)-1].lsn)
+	for _, req := range batch {
+		if req.background {
+			atomic.StoreUint64(&g.backgroundLSN, req.lsn)
+		}
+	}
+
+	// 1 つでも sync を待つ tx があれば batch 全体を fsync する
+	for _, req := range batch {
+		if req.sync {
+			return g.sync()
+		}
+	}
+	return nil
+}
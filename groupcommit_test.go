@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	db := newTempDB(t, Options{GroupCommitSize: 16, GroupCommitWait: 10 * time.Millisecond})
+
+	n := 64
+	lsns := make([]uint64, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx := NewTx(db)
+			defer tx.DestructTx()
+			if err := tx.Insert(fmt.Sprintf("key%v", i), fmt.Sprintf("value%v", i)); err != nil {
+				t.Errorf("failed to insert: %v", err)
+				return
+			}
+			lsn, err := tx.Commit()
+			if err != nil {
+				t.Errorf("failed to commit: %v", err)
+			}
+			if durable := db.DurableLSN(); durable < lsn {
+				t.Errorf("commit returned before durable: lsn = %v, durable = %v", lsn, durable)
+			}
+			lsns[i] = lsn
+		}(i)
+	}
+	wg.Wait()
+	db.wal.close()
+
+	// 1 tx = begin + insert + commit
+	seen := make(map[uint64]bool)
+	for _, lsn := range lsns {
+		if lsn == 0 || lsn > uint64(3*n) || seen[lsn] {
+			t.Errorf("wrong lsn: %v", lsn)
+		}
+		seen[lsn] = true
+	}
+	if db.DurableLSN() != uint64(3*n) {
+		t.Errorf("wrong durable lsn: %v", db.DurableLSN())
+	}
+
+	if db.wal.batches >= uint64(n) {
+		t.Errorf("commits are not grouped: %v fsync for %v txs", db.wal.batches, n)
+	}
+	if _, err := db.wal.commit(nil, SyncOnCommit); err != errWALClosed {
+		t.Errorf("should be closed: %v", err)
+	}
+
+	// 全ての tx が wal に残っている
+	recovered := NewDB(db.wal.log.prefix, db.dbFileName, Options{})
+	defer recovered.close()
+	if report := recovered.loadWal(); report.Committed != n || report.LastLSN != uint64(3*n) {
+		t.Errorf("wrong number of txs in wal: %v", report)
+	}
+}
+
+func TestGroupCommit_Durability(t *testing.T) {
+	db := newTempDB(t, Options{Durability: NoSync})
+	commit := func(key string, durability Durability) uint64 {
+		tx := NewTx(db)
+		defer tx.DestructTx()
+		tx.SetDurability(durability)
+		tx.Insert(key, "value")
+		lsn, err := tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lsn
+	}
+
+	// nosync は write だけで返る
+	lsn := commit("key1", NoSync)
+	if db.wal.written() < lsn || db.DurableLSN() >= lsn || db.wal.syncs != 0 {
+		t.Errorf("should not be synced: lsn = %v, durable = %v", lsn, db.DurableLSN())
+	}
+	// 次の sync tx が前の tx もまとめて永続化する
+	lsn = commit("key2", SyncOnCommit)
+	if db.DurableLSN() < lsn || db.wal.syncs != 1 {
+		t.Errorf("should be synced: lsn = %v, durable = %v", lsn, db.DurableLSN())
+	}
+
+	// background は interval 毎に sync する
+	bg := newTempDB(t, Options{Durability: BackgroundSync, SyncInterval: time.Millisecond})
+	tx := NewTx(bg)
+	tx.Insert("key1", "value")
+	lsn, err := tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.DestructTx()
+	deadline := time.Now().Add(time.Second)
+	for bg.DurableLSN() < lsn && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if bg.DurableLSN() < lsn {
+		t.Errorf("should be synced in background: lsn = %v, durable = %v", lsn, bg.DurableLSN())
+	}
+
+	// server の設定が sync でも background の tx は sync される
+	syncDB := newTempDB(t, Options{SyncInterval: time.Millisecond})
+	tx = NewTx(syncDB)
+	tx.SetDurability(BackgroundSync)
+	tx.Insert("key1", "value")
+	if lsn, err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.DestructTx()
+	deadline = time.Now().Add(time.Second)
+	for syncDB.DurableLSN() < lsn && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if syncDB.DurableLSN() < lsn {
+		t.Errorf("background tx should be synced: lsn = %v, durable = %v", lsn, syncDB.DurableLSN())
+	}
+
+	// close で全て永続化される
+	lsn = commit("key3", NoSync)
+	db.wal.close()
+	if db.DurableLSN() != lsn {
+		t.Errorf("should be synced on close: lsn = %v, durable = %v", lsn, db.DurableLSN())
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HTTP/JSON API
+// GET /kv/{key}:    {"key": key, "value": value}
+// PUT /kv/{key}:    body は {"value": value}、key が無ければ insert、あれば update
+// DELETE /kv/{key}: key を削除する
+// POST /txn:        {"ops": [{"op": "read", "key": key}, ...], "durability": "sync"}
+// /kv/ はそれぞれ 1 つの tx で、/txn の ops は 1 つの tx で実行し、どれかが失敗すれば何も書かない
+// 書き込みに成功すると {"lsn": lsn} を返す (PUT, DELETE の durability は ?durability=)
+// error は {"error": {"code": "not_found", "message": "...", "op": 0}} (op は /txn で失敗した op の index)
+const (
+	DefaultHTTPAddr = ":7780"
+	maxHTTPBodySize = MaxFrameSize
+)
+
+// httpErrors are the HTTP status and the name of each error code.
+var httpErrors = map[uint16]struct {
+	status int
+	name   string
+}{
+	ErrCodeInternal:      {http.StatusInternalServerError, "internal"},
+	ErrCodeBadRequest:    {http.StatusBadRequest, "bad_request"},
+	ErrCodeNotFound:      {http.StatusNotFound, "not_found"},
+	ErrCodeAlreadyExists: {http.StatusConflict, "already_exists"},
+	ErrCodeConflict:      {http.StatusConflict, "conflict"},
+	ErrCodeReadOnly:      {http.StatusServiceUnavailable, "read_only"},
+}
+
+type httpError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Op      *int   `json:"op,omitempty"` // the index of the failed op in /txn
+}
+
+type httpOp struct {
+	Op    string  `json:"op"` // read, insert, update, put, delete
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+}
+
+type httpTxnRequest struct {
+	Ops        []httpOp `json:"ops"`
+	Durability string   `json:"durability,omitempty"`
+}
+
+type httpResult struct {
+	Value *string `json:"value,omitempty"` // read
+}
+
+type httpTxnResponse struct {
+	Results []httpResult `json:"results"`
+	LSN     uint64       `json:"lsn,omitempty"`
+}
+
+// HTTPHandler returns the handler of the HTTP/JSON API.
+func (db *DB) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", db.serveKV)
+	mux.HandleFunc("/txn", db.serveTxn)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as {"error": {...}}. op is the index of the failed op
+// in /txn, or -1.
+func writeError(w http.ResponseWriter, err error, op int) {
+	e := httpErrors[errorCode(err)]
+	body := httpError{Code: e.name, Message: err.Error()}
+	if op >= 0 {
+		body.Op = &op
+	}
+	writeJSON(w, e.status, map[string]httpError{"error": body})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]httpError{"error": {
+		Code:    httpErrors[ErrCodeBadRequest].name,
+		Message: "method not allowed",
+	}})
+}
+
+// parseHTTPDurability parses the durability of a request, empty means the
+// default of the DB.
+func parseHTTPDurability(tx *Tx, s string) error {
+	if s == "" {
+		return nil
+	}
+	durability, err := ParseDurability(s)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	tx.SetDurability(durability)
+	return nil
+}
+
+// upsert inserts key if it does not exist and updates it otherwise.
+func upsert(tx *Tx, key, value string) error {
+	_, err := tx.Read(key)
+	if errors.Is(err, errKeyNotExist) {
+		return tx.Insert(key, value)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Update(key, value)
+}
+
+// checkExists returns the error of an insert (exists) or an update or a delete
+// (!exists) of key. Insert, Update and Delete of Tx find it only at commit.
+func checkExists(tx *Tx, key string, exists bool) error {
+	_, err := tx.Read(key)
+	if err != nil && !errors.Is(err, errKeyNotExist) {
+		return err
+	}
+	if exists && err != nil {
+		return errKeyNotExist
+	}
+	if !exists && err == nil {
+		return errKeyExists
+	}
+	return nil
+}
+
+func (db *DB) serveKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	if key == "" {
+		writeError(w, fmt.Errorf("%w: key is missing", errBadRequest), -1)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		methodNotAllowed(w, "GET, PUT, DELETE")
+		return
+	}
+
+	tx := NewTx(db)
+	defer tx.DestructTx()
+	if err := parseHTTPDurability(tx, r.URL.Query().Get("durability")); err != nil {
+		writeError(w, err, -1)
+		return
+	}
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		var value string
+		if value, err = tx.Read(key); err == nil {
+			writeJSON(w, http.StatusOK, map[string]string{"key": key, "value": value})
+			return
+		}
+	case http.MethodPut:
+		var body struct {
+			Value *string `json:"value"`
+		}
+		if err = decodeJSON(w, r, &body); err == nil && body.Value == nil {
+			err = fmt.Errorf("%w: value is missing", errBadRequest)
+		}
+		if err == nil {
+			err = upsert(tx, key, *body.Value)
+		}
+	case http.MethodDelete:
+		if err = checkExists(tx, key, true); err == nil {
+			err = tx.Delete(key)
+		}
+	}
+	if err != nil {
+		writeError(w, err, -1)
+		return
+	}
+	lsn, err := tx.Commit()
+	if err != nil {
+		writeError(w, err, -1)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uint64{"lsn": lsn})
+}
+
+func (db *DB) serveTxn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	var req httpTxnRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, err, -1)
+		return
+	}
+
+	tx := NewTx(db)
+	defer tx.DestructTx()
+	if err := parseHTTPDurability(tx, req.Durability); err != nil {
+		writeError(w, err, -1)
+		return
+	}
+	resp := httpTxnResponse{Results: make([]httpResult, len(req.Ops))}
+	for i, op := range req.Ops {
+		value, err := runHTTPOp(tx, op)
+		if err != nil {
+			// Commit しなければ何も書かない
+			writeError(w, err, i)
+			return
+		}
+		resp.Results[i].Value = value
+	}
+	lsn, err := tx.Commit()
+	if err != nil {
+		writeError(w, err, -1)
+		return
+	}
+	resp.LSN = lsn
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// runHTTPOp runs op in tx and returns the value read.
+func runHTTPOp(tx *Tx, op httpOp) (*string, error) {
+	if op.Key == "" {
+		return nil, fmt.Errorf("%w: key is missing", errBadRequest)
+	}
+	hasValue := op.Op == "insert" || op.Op == "update" || op.Op == "put"
+	if hasValue != (op.Value != nil) {
+		if hasValue {
+			return nil, fmt.Errorf("%w: value is missing", errBadRequest)
+		}
+		return nil, fmt.Errorf("%w: %v has no value", errBadRequest, op.Op)
+	}
+	var err error
+	switch op.Op {
+	case "read":
+		value, err := tx.Read(op.Key)
+		if err != nil {
+			return nil, err
+		}
+		return &value, nil
+	case "insert":
+		if err = checkExists(tx, op.Key, false); err == nil {
+			err = tx.Insert(op.Key, *op.Value)
+		}
+	case "update":
+		if err = checkExists(tx, op.Key, true); err == nil {
+			err = tx.Update(op.Key, *op.Value)
+		}
+	case "put":
+		err = upsert(tx, op.Key, *op.Value)
+	case "delete":
+		if err = checkExists(tx, op.Key, true); err == nil {
+			err = tx.Delete(op.Key)
+		}
+	default:
+		err = fmt.Errorf("%w: unknown op %q", errBadRequest, op.Op)
+	}
+	return nil, err
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHTTPBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return nil
+}
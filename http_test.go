@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newHTTPTestServer(t *testing.T) *httptest.Server {
+	db := newTempDB(t, Options{})
+	server := httptest.NewServer(db.HTTPHandler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// doHTTP sends a request and returns the status and the decoded JSON body.
+func doHTTP(t *testing.T, server *httptest.Server, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%v %v: content type %q", method, path, ct)
+	}
+	var v map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatalf("%v %v: %v", method, path, err)
+	}
+	return resp.StatusCode, v
+}
+
+func errorOf(v map[string]interface{}) map[string]interface{} {
+	e, _ := v["error"].(map[string]interface{})
+	return e
+}
+
+func TestHTTP_KV(t *testing.T) {
+	server := newHTTPTestServer(t)
+
+	if status, v := doHTTP(t, server, "GET", "/kv/key", ""); status != http.StatusNotFound || errorOf(v)["code"] != "not_found" {
+		t.Errorf("get of a missing key: %v %v", status, v)
+	}
+	if status, v := doHTTP(t, server, "PUT", "/kv/key%20with%2Fslash", `{"value": "1"}`); status != http.StatusOK || v["lsn"].(float64) == 0 {
+		t.Errorf("put: %v %v", status, v)
+	}
+	if status, v := doHTTP(t, server, "PUT", "/kv/key%20with%2Fslash?durability=nosync", `{"value": "2 \n"}`); status != http.StatusOK {
+		t.Errorf("put of an existing key: %v %v", status, v)
+	}
+	if status, v := doHTTP(t, server, "GET", "/kv/key%20with%2Fslash", ""); status != http.StatusOK || v["key"] != "key with/slash" || v["value"] != "2 \n" {
+		t.Errorf("get: %v %v", status, v)
+	}
+	if status, v := doHTTP(t, server, "DELETE", "/kv/key%20with%2Fslash", ""); status != http.StatusOK {
+		t.Errorf("delete: %v %v", status, v)
+	}
+	if status, v := doHTTP(t, server, "DELETE", "/kv/key%20with%2Fslash", ""); status != http.StatusNotFound {
+		t.Errorf("delete of a missing key: %v %v", status, v)
+	}
+
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"PUT", "/kv/key", `{"val": "1"}`, http.StatusBadRequest},
+		{"PUT", "/kv/key", `{}`, http.StatusBadRequest},
+		{"PUT", "/kv/key", `not json`, http.StatusBadRequest},
+		{"PUT", "/kv/key?durability=always", `{"value": "1"}`, http.StatusBadRequest},
+		{"GET", "/kv/", "", http.StatusBadRequest},
+		{"POST", "/kv/key", "", http.StatusMethodNotAllowed},
+		{"GET", "/txn", "", http.StatusMethodNotAllowed},
+	} {
+		status, v := doHTTP(t, server, tt.method, tt.path, tt.body)
+		if status != tt.status || errorOf(v)["code"] != "bad_request" || errorOf(v)["message"] == "" {
+			t.Errorf("%v %v %v: %v %v", tt.method, tt.path, tt.body, status, v)
+		}
+	}
+}
+
+func TestHTTP_Txn(t *testing.T) {
+	server := newHTTPTestServer(t)
+	doHTTP(t, server, "PUT", "/kv/key1", `{"value": "1"}`)
+
+	status, v := doHTTP(t, server, "POST", "/txn", `{"ops": [
+		{"op": "read", "key": "key1"},
+		{"op": "update", "key": "key1", "value": "2"},
+		{"op": "insert", "key": "key2", "value": "3"},
+		{"op": "put", "key": "key3", "value": "4"},
+		{"op": "read", "key": "key1"}
+	], "durability": "nosync"}`)
+	if status != http.StatusOK || v["lsn"].(float64) == 0 {
+		t.Fatalf("txn: %v %v", status, v)
+	}
+	want := []interface{}{
+		map[string]interface{}{"value": "1"},
+		map[string]interface{}{},
+		map[string]interface{}{},
+		map[string]interface{}{},
+		map[string]interface{}{"value": "2"},
+	}
+	if !reflect.DeepEqual(v["results"], want) {
+		t.Errorf("results: got %v, want %v", v["results"], want)
+	}
+
+	// どれかが失敗すれば何も書かない
+	status, v = doHTTP(t, server, "POST", "/txn", `{"ops": [
+		{"op": "delete", "key": "key1"},
+		{"op": "insert", "key": "key4", "value": "5"},
+		{"op": "insert", "key": "key2", "value": "6"}
+	]}`)
+	if e := errorOf(v); status != http.StatusConflict || e["code"] != "already_exists" || e["op"] != 2.0 {
+		t.Errorf("failed txn: %v %v", status, v)
+	}
+	if status, v := doHTTP(t, server, "GET", "/kv/key1", ""); status != http.StatusOK || v["value"] != "2" {
+		t.Errorf("key1 is deleted: %v %v", status, v)
+	}
+	if status, _ := doHTTP(t, server, "GET", "/kv/key4", ""); status != http.StatusNotFound {
+		t.Errorf("key4 is inserted: %v", status)
+	}
+
+	// 読むだけの tx は wal に書かない
+	if status, v := doHTTP(t, server, "POST", "/txn", `{"ops": [{"op": "read", "key": "key2"}]}`); status != http.StatusOK || v["lsn"] != nil {
+		t.Errorf("read-only txn: %v %v", status, v)
+	}
+	for _, body := range []string{
+		`{"ops": [{"op": "scan", "key": "key1"}]}`,
+		`{"ops": [{"op": "read", "key": "key1", "value": "1"}]}`,
+		`{"ops": [{"op": "insert", "key": "key5"}]}`,
+		`{"ops": [{"op": "read", "key": ""}]}`,
+	} {
+		if status, v := doHTTP(t, server, "POST", "/txn", body); status != http.StatusBadRequest || errorOf(v)["op"] != 0.0 {
+			t.Errorf("%v: %v %v", body, status, v)
+		}
+	}
+}
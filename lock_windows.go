@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockFile creates path exclusively. The file is left if the process
+// crashes, and has to be removed by hand.
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%w (remove %v if no process uses it)", errLocked, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(file, os.Getpid())
+	return file, nil
+}
+
+func unlockFile(file *os.File) error {
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 const (
@@ -16,9 +19,68 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restoreCommand(os.Args[2:])
+			return
+		case "waldump":
+			waldumpCommand(os.Args[2:])
+			return
+		case "check":
+			checkCommand(os.Args[2:])
+			return
+		}
+	}
+
+	dataDir := flag.String("data-dir", ".", "directory of db-file and the wal")
+	recoveryPolicy := flag.String("recovery", "stop", "what to do with a corrupted WAL record (stop, skip)")
+	forceRecovery := flag.Bool("force-recovery", false, "start even if db-file is corrupted, skipping the broken blocks")
+	groupCommitSize := flag.Int("group-commit-size", DefaultGroupCommitSize, "max number of txs written by one fsync")
+	groupCommitWait := flag.Duration("group-commit-wait", 0, "how long to wait for more txs before fsync")
+	durability := flag.String("durability", "sync", "when to fsync the wal (sync: on commit, background: every -sync-interval, nosync: never)")
+	syncInterval := flag.Duration("sync-interval", DefaultSyncInterval, "fsync interval of background durability txs")
+	segmentSize := flag.Int64("segment-size", DefaultSegmentSize, "max size of a wal segment in bytes")
+	archiveDir := flag.String("archive-dir", "", "directory old wal segments are moved to (deleted if empty)")
+	checkpointInterval := flag.Duration("checkpoint-interval", time.Minute, "interval of online checkpoints (0 disables them)")
+	compression := flag.String("compression", "none", "codec of db-file blocks and large wal records (none, flate)")
+	binaryAddr := flag.String("binary-addr", DefaultBinaryAddr, "address of the binary protocol (empty disables it)")
+	respAddr := flag.String("resp-addr", DefaultRESPAddr, "address of the Redis compatible protocol (empty disables it)")
+	httpAddr := flag.String("http-addr", DefaultHTTPAddr, "address of the HTTP/JSON API (empty disables it)")
+	keys := addKeyFlags(flag.CommandLine)
+	flag.Parse()
+
+	opts := Options{
+		ForceRecovery:   *forceRecovery,
+		GroupCommitSize: *groupCommitSize,
+		GroupCommitWait: *groupCommitWait,
+		SyncInterval:    *syncInterval,
+		SegmentSize:     *segmentSize,
+		ArchiveDir:      *archiveDir,
+
+		CheckpointInterval: *checkpointInterval,
+	}
+	var err error
+	if opts.RecoveryPolicy, err = ParseRecoveryPolicy(*recoveryPolicy); err != nil {
+		log.Fatal(err)
+	}
+	if opts.Durability, err = ParseDurability(*durability); err != nil {
+		log.Fatal(err)
+	}
+	if opts.Compression, err = ParseCompression(*compression); err != nil {
+		log.Fatal(err)
+	}
+	if opts.Keys, err = keys.load(); err != nil {
+		log.Fatal(err)
+	}
+
 	fmt.Println("starting seccampdb...")
 
-	db := NewDB(WALFileName, DBFileName)
+	dir, err := OpenDataDir(*dataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db := dir.OpenDB(opts)
 	db.Setup()
 
 	tcpAddr, err := net.ResolveTCPAddr("tcp", ":7777")
@@ -30,6 +92,46 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *binaryAddr != "" {
+		binaryListener, err := net.Listen("tcp", *binaryAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := binaryListener.Accept()
+				if err != nil {
+					continue
+				}
+				go db.ServeBinary(conn)
+			}
+		}()
+	}
+	if *respAddr != "" {
+		respListener, err := net.Listen("tcp", *respAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := respListener.Accept()
+				if err != nil {
+					continue
+				}
+				go db.ServeRESP(conn)
+			}
+		}()
+	}
+	if *httpAddr != "" {
+		httpListener, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Println("http:", http.Serve(httpListener, db.HTTPHandler()))
+		}()
+	}
+
 	go func() {
 		scanner := bufio.NewScanner(os.Stdin)
 		for {
@@ -39,6 +141,24 @@ func main() {
 				if len(input) == 1 && input[0] == "exit" {
 					db.Shutdown()
 				}
+				if len(input) > 0 && input[0] == "backup" {
+					if len(input) != 2 && len(input) != 3 {
+						fmt.Println("wrong format -> backup <dir> [<parent backup dir>]")
+						continue
+					}
+					var manifest *BackupManifest
+					var err error
+					if len(input) == 3 {
+						manifest, err = db.BackupIncremental(input[1], input[2])
+					} else {
+						manifest, err = db.Backup(input[1])
+					}
+					if err != nil {
+						fmt.Println("backup failed:", err)
+						continue
+					}
+					fmt.Printf("%v backup done (lsn: %v-%v)\n", manifest.Type, manifest.StartLSN, manifest.EndLSN)
+				}
 			}
 		}
 	}()
@@ -49,6 +169,6 @@ func main() {
 			continue
 		}
 		fmt.Println("--- new connection ---")
-		go db.StartTx(conn)
+		go db.ServeTelnet(conn)
 	}
 }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memFS is a FileSystem in memory for tests. It remembers which data and
+// which directory entries have been made durable, and Crash returns the
+// files as they would be after a power failure.
+type memFS struct {
+	mu     sync.Mutex
+	files  map[string]*memInode // current directory entries
+	synced map[string]*memInode // directory entries as of the last SyncDir
+	dirs   map[string]bool
+}
+
+type memInode struct {
+	data   []byte
+	synced []byte // data as of the last Sync
+}
+
+func newMemFS() *memFS {
+	return &memFS{
+		files:  make(map[string]*memInode),
+		synced: make(map[string]*memInode),
+		dirs:   map[string]bool{".": true, "/": true},
+	}
+}
+
+// Crash returns the file system after a power failure: only the synced data
+// of the synced directory entries is left. If torn, half of the data written
+// after the last Sync is also left, like a torn write.
+func (fs *memFS) Crash(torn bool) *memFS {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	crashed := newMemFS()
+	for name, inode := range fs.synced {
+		data := inode.synced
+		if torn && len(inode.data) > len(data) && bytes.HasPrefix(inode.data, data) {
+			data = inode.data[:len(data)+(len(inode.data)-len(data))/2]
+		}
+		data = append([]byte(nil), data...)
+		crashed.files[name] = &memInode{data: data, synced: data}
+		crashed.synced[name] = crashed.files[name]
+	}
+	for dir := range fs.dirs {
+		crashed.dirs[dir] = true
+	}
+	return crashed
+}
+
+func (fs *memFS) addDir(dir string) {
+	for ; !fs.dirs[dir]; dir = filepath.Dir(dir) {
+		fs.dirs[dir] = true
+	}
+}
+
+func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = filepath.Clean(name)
+	inode, exist := fs.files[name]
+	switch {
+	case exist && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !exist && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !exist:
+		inode = &memInode{}
+		fs.files[name] = inode
+		fs.addDir(filepath.Dir(name))
+	}
+	if flag&os.O_TRUNC != 0 {
+		inode.data = nil
+	}
+	return &memFile{fs: fs, name: name, inode: inode, flag: flag}, nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, exist := fs.files[name]; exist {
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		for file := range fs.files {
+			if filepath.Dir(file) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *memFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	oldpath = filepath.Clean(oldpath)
+	newpath = filepath.Clean(newpath)
+	inode, exist := fs.files[oldpath]
+	if !exist {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = inode
+	fs.addDir(filepath.Dir(newpath))
+	return nil
+}
+
+func (fs *memFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.addDir(filepath.Clean(path))
+	return nil
+}
+
+func (fs *memFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dirname = filepath.Clean(dirname)
+	if !fs.dirs[dirname] {
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for name, inode := range fs.files {
+		if filepath.Dir(name) == dirname {
+			infos = append(infos, &memFileInfo{name: filepath.Base(name), size: int64(len(inode.data))})
+		}
+	}
+	for dir := range fs.dirs {
+		if dir != dirname && filepath.Dir(dir) == dirname {
+			infos = append(infos, &memFileInfo{name: filepath.Base(dir), dir: true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = filepath.Clean(name)
+	if inode, exist := fs.files[name]; exist {
+		return &memFileInfo{name: filepath.Base(name), size: int64(len(inode.data))}, nil
+	}
+	if fs.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *memFS) SyncDir(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dir = filepath.Clean(dir)
+	for name := range fs.synced {
+		if filepath.Dir(name) == dir {
+			delete(fs.synced, name)
+		}
+	}
+	for name, inode := range fs.files {
+		if filepath.Dir(name) == dir {
+			fs.synced[name] = inode
+		}
+	}
+	return nil
+}
+
+// String lists the files for debugging.
+func (fs *memFS) String() string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var names []string
+	for name := range fs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n")
+}
+
+type memFile struct {
+	fs     *memFS
+	name   string
+	inode  *memInode
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+	if f.offset >= int64(len(f.inode.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.inode.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.inode.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.inode.data)) {
+		data := make([]byte, end)
+		copy(data, f.inode.data)
+		f.inode.data = data
+	}
+	copy(f.inode.data[f.offset:], p)
+	f.offset = end
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.inode.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	f.inode.synced = append([]byte(nil), f.inode.data...)
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi *memFileInfo) Name() string { return fi.name }
+func (fi *memFileInfo) Size() int64  { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0777
+	}
+	return 0666
+}
+func (fi *memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
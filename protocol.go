@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+// binary protocol
+// frame:    | length (4) | payload |
+// request:  | opcode (1) | args |
+// READ, DELETE の args:   | key size (4) | key |
+// INSERT, UPDATE の args: | key size (4) | key | value |
+// COMMIT の args:         | durability + 1 (1) | (省略するか 0 なら server の設定)
+// response: | status (1) | body |
+// StatusOK の body:       READ は value、COMMIT は | lsn (8) |、他は空
+// それ以外の body:        | error code (2) | message |
+// opcode は READ..ABORT と同じ値で、key と value は任意の byte 列
+// tx は最初の request で始まり、COMMIT か ABORT の次の request で次の tx が始まる
+const (
+	DefaultBinaryAddr = ":7778"
+	frameHeaderSize   = 4
+	MaxFrameSize      = 64 << 20
+)
+
+// response status
+const (
+	StatusOK      uint8 = iota
+	StatusError         // the operation failed, the tx continues
+	StatusAborted       // the tx is aborted
+)
+
+// error code
+const (
+	ErrCodeNone uint16 = iota
+	ErrCodeInternal
+	ErrCodeBadRequest
+	ErrCodeNotFound
+	ErrCodeAlreadyExists
+	ErrCodeConflict // commit failed because of another tx
+	ErrCodeReadOnly
+)
+
+var (
+	errBadRequest    = errors.New("bad request")
+	errBadResponse   = errors.New("bad response")
+	errFrameTooLarge = errors.New("frame too large")
+)
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+func writeFrame(w io.Writer, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return errFrameTooLarge
+	}
+	buf := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+type binaryRequest struct {
+	op         uint8
+	key        string
+	value      string
+	durability *Durability // COMMIT, nil means the default
+}
+
+func encodeRequest(req *binaryRequest) []byte {
+	buf := []byte{req.op}
+	switch req.op {
+	case READ, INSERT, UPDATE, DELETE:
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(req.key)))
+		buf = append(buf, size[:]...)
+		buf = append(buf, req.key...)
+		buf = append(buf, req.value...)
+	case COMMIT:
+		if req.durability != nil {
+			buf = append(buf, uint8(*req.durability)+1)
+		}
+	}
+	return buf
+}
+
+func parseRequest(payload []byte) (*binaryRequest, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("%w: empty request", errBadRequest)
+	}
+	req := &binaryRequest{op: payload[0]}
+	args := payload[1:]
+	switch req.op {
+	case READ, INSERT, UPDATE, DELETE:
+		if len(args) < 4 {
+			return nil, fmt.Errorf("%w: key is missing", errBadRequest)
+		}
+		size := binary.BigEndian.Uint32(args)
+		if uint64(size) > uint64(len(args)-4) {
+			return nil, fmt.Errorf("%w: key is truncated", errBadRequest)
+		}
+		req.key = string(args[4 : 4+size])
+		req.value = string(args[4+size:])
+		if (req.op == READ || req.op == DELETE) && req.value != "" {
+			return nil, fmt.Errorf("%w: %v has no value", errBadRequest, opName(req.op))
+		}
+	case COMMIT:
+		if len(args) > 1 {
+			return nil, fmt.Errorf("%w: too many arguments", errBadRequest)
+		}
+		if len(args) == 1 && args[0] > 0 {
+			durability := Durability(args[0] - 1)
+			if durability > NoSync {
+				return nil, fmt.Errorf("%w: unknown durability %v", errBadRequest, args[0])
+			}
+			req.durability = &durability
+		}
+	case ABORT:
+		if len(args) > 0 {
+			return nil, fmt.Errorf("%w: too many arguments", errBadRequest)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown opcode %v", errBadRequest, req.op)
+	}
+	return req, nil
+}
+
+type binaryResponse struct {
+	status uint8
+	code   uint16 // StatusError, StatusAborted
+	body   []byte // value, lsn or error message
+}
+
+func errorResponse(status uint8, err error) *binaryResponse {
+	return &binaryResponse{status: status, code: errorCode(err), body: []byte(err.Error())}
+}
+
+// errorCode returns the error code sent for err.
+func errorCode(err error) uint16 {
+	switch {
+	case errors.Is(err, errBadRequest), errors.Is(err, errFrameTooLarge):
+		return ErrCodeBadRequest
+	case errors.Is(err, errKeyNotExist):
+		return ErrCodeNotFound
+	case errors.Is(err, errKeyExists):
+		return ErrCodeAlreadyExists
+	case errors.Is(err, errCommitFailed):
+		return ErrCodeConflict
+	case errors.Is(err, errReadOnly):
+		return ErrCodeReadOnly
+	}
+	return ErrCodeInternal
+}
+
+func encodeResponse(resp *binaryResponse) []byte {
+	if resp.status == StatusOK {
+		return append([]byte{resp.status}, resp.body...)
+	}
+	buf := make([]byte, 3, 3+len(resp.body))
+	buf[0] = resp.status
+	binary.BigEndian.PutUint16(buf[1:], resp.code)
+	return append(buf, resp.body...)
+}
+
+func parseResponse(payload []byte) (*binaryResponse, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("%w: empty response", errBadResponse)
+	}
+	resp := &binaryResponse{status: payload[0], body: payload[1:]}
+	switch resp.status {
+	case StatusOK:
+	case StatusError, StatusAborted:
+		if len(resp.body) < 2 {
+			return nil, fmt.Errorf("%w: error code is missing", errBadResponse)
+		}
+		resp.code = binary.BigEndian.Uint16(resp.body)
+		resp.body = resp.body[2:]
+	default:
+		return nil, fmt.Errorf("%w: unknown status %v", errBadResponse, resp.status)
+	}
+	return resp, nil
+}
+
+// ServeBinary runs the txs requested on conn in the binary protocol until the
+// connection is closed. A tx left open is aborted.
+func (db *DB) ServeBinary(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	var tx *Tx
+	defer func() {
+		if tx != nil {
+			tx.DestructTx()
+		}
+	}()
+
+	for {
+		payload, err := readFrame(reader)
+		if err == errFrameTooLarge {
+			// frame の境界が分からないので切断する
+			writeFrame(writer, encodeResponse(errorResponse(StatusError, err)))
+			writer.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println("binary protocol:", err)
+			}
+			return
+		}
+
+		var resp *binaryResponse
+		req, err := parseRequest(payload)
+		if err != nil {
+			resp = errorResponse(StatusError, err)
+		} else {
+			if tx == nil {
+				tx = NewTx(db)
+			}
+			resp = execute(tx, req)
+			if req.op == COMMIT || req.op == ABORT {
+				tx.DestructTx()
+				tx = nil
+			}
+		}
+		if err := writeFrame(writer, encodeResponse(resp)); err != nil {
+			return
+		}
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs req in tx. The caller ends tx after COMMIT and ABORT.
+func execute(tx *Tx, req *binaryRequest) *binaryResponse {
+	var err error
+	switch req.op {
+	case READ:
+		var value string
+		if value, err = tx.Read(req.key); err == nil {
+			return &binaryResponse{status: StatusOK, body: []byte(value)}
+		}
+	case INSERT:
+		err = tx.Insert(req.key, req.value)
+	case UPDATE:
+		err = tx.Update(req.key, req.value)
+	case DELETE:
+		err = tx.Delete(req.key)
+	case COMMIT:
+		if req.durability != nil {
+			tx.SetDurability(*req.durability)
+		}
+		lsn, err := tx.Commit()
+		if err != nil {
+			return errorResponse(StatusAborted, err)
+		}
+		body := make([]byte, 8)
+		binary.BigEndian.PutUint64(body, lsn)
+		return &binaryResponse{status: StatusOK, body: body}
+	case ABORT:
+	}
+	if err != nil {
+		return errorResponse(StatusError, err)
+	}
+	return &binaryResponse{status: StatusOK}
+}
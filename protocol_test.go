@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// binaryConn sends requests to DB.ServeBinary.
+type binaryConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func newBinaryConn(t *testing.T, db *DB) *binaryConn {
+	client, server := net.Pipe()
+	go db.ServeBinary(server)
+	t.Cleanup(func() { client.Close() })
+	return &binaryConn{t: t, conn: client}
+}
+
+func (c *binaryConn) send(payload []byte) *binaryResponse {
+	c.t.Helper()
+	if err := writeFrame(c.conn, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	buf, err := readFrame(c.conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp, err := parseResponse(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+func (c *binaryConn) do(req *binaryRequest) *binaryResponse {
+	c.t.Helper()
+	return c.send(encodeRequest(req))
+}
+
+func TestServeBinary(t *testing.T) {
+	db := newTempDB(t, Options{})
+	c := newBinaryConn(t, db)
+
+	// 空白、改行や任意の byte を含む key と value
+	key := "key with\nspaces"
+	value := string([]byte{0, 1, ' ', '\n', 0xff})
+	if resp := c.do(&binaryRequest{op: INSERT, key: key, value: value}); resp.status != StatusOK {
+		t.Fatalf("insert: %+v", resp)
+	}
+	durability := NoSync
+	resp := c.do(&binaryRequest{op: COMMIT, durability: &durability})
+	if resp.status != StatusOK || len(resp.body) != 8 || binary.BigEndian.Uint64(resp.body) == 0 {
+		t.Fatalf("commit: %+v", resp)
+	}
+
+	// 同じ connection で次の tx
+	if resp := c.do(&binaryRequest{op: READ, key: key}); resp.status != StatusOK || string(resp.body) != value {
+		t.Errorf("read: %+v", resp)
+	}
+	if resp := c.do(&binaryRequest{op: READ, key: "nothing"}); resp.status != StatusError || resp.code != ErrCodeNotFound {
+		t.Errorf("read of a missing key: %+v", resp)
+	}
+	if resp := c.do(&binaryRequest{op: INSERT, key: key, value: "v"}); resp.status != StatusError || resp.code != ErrCodeAlreadyExists {
+		t.Errorf("insert of an existing key: %+v", resp)
+	}
+	if resp := c.do(&binaryRequest{op: ABORT}); resp.status != StatusOK {
+		t.Errorf("abort: %+v", resp)
+	}
+
+	// 壊れた request の後も続けられる
+	for _, payload := range [][]byte{{}, {99}, {READ, 0, 0, 0, 9, 'k'}, {COMMIT, 9}} {
+		if resp := c.send(payload); resp.status != StatusError || resp.code != ErrCodeBadRequest {
+			t.Errorf("%v: %+v", payload, resp)
+		}
+	}
+	if resp := c.do(&binaryRequest{op: READ, key: key}); resp.status != StatusOK || string(resp.body) != value {
+		t.Errorf("read after bad requests: %+v", resp)
+	}
+}
+
+func TestServeBinary_Conflict(t *testing.T) {
+	db := newTempDB(t, Options{})
+	c1 := newBinaryConn(t, db)
+	c2 := newBinaryConn(t, db)
+
+	c1.do(&binaryRequest{op: INSERT, key: "key", value: "1"})
+	c2.do(&binaryRequest{op: INSERT, key: "key", value: "2"})
+	if resp := c1.do(&binaryRequest{op: COMMIT}); resp.status != StatusOK {
+		t.Fatalf("commit: %+v", resp)
+	}
+	if resp := c2.do(&binaryRequest{op: COMMIT}); resp.status != StatusAborted || resp.code != ErrCodeConflict {
+		t.Errorf("commit of a conflicting tx: %+v", resp)
+	}
+}
+
+func TestServeBinary_FrameTooLarge(t *testing.T) {
+	db := newTempDB(t, Options{})
+	c := newBinaryConn(t, db)
+
+	header := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(header, MaxFrameSize+1)
+	if _, err := c.conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := readFrame(c.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := parseResponse(buf); err != nil || resp.code != ErrCodeBadRequest {
+		t.Errorf("got %+v, %v", resp, err)
+	}
+	if _, err := readFrame(c.conn); err == nil {
+		t.Error("connection should be closed")
+	}
+	if !bytes.Equal(encodeResponse(&binaryResponse{status: StatusOK}), []byte{StatusOK}) {
+		t.Error("wrong encoding of an empty response")
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// RecoveryPolicy decides what loadWal does when it finds a corrupted record.
+type RecoveryPolicy int
+
+const (
+	// StopAtCorruption replays the WAL up to the first corrupted record (or
+	// missing segment) and drops everything after it.
+	StopAtCorruption RecoveryPolicy = iota
+	// SkipTransaction drops only the tx containing the corrupted record and
+	// continues with the next valid record.
+	SkipTransaction
+)
+
+func ParseRecoveryPolicy(s string) (RecoveryPolicy, error) {
+	switch s {
+	case "stop":
+		return StopAtCorruption, nil
+	case "skip":
+		return SkipTransaction, nil
+	}
+	return 0, fmt.Errorf("unknown recovery policy: %v", s)
+}
+
+// RecoveryReport describes what loadWal replayed and what it dropped.
+type RecoveryReport struct {
+	LastLSN      uint64      // lsn of the last valid record
+	LastTs       uint64      // largest ts of the valid records
+	Committed    int         // replayed txs
+	Checkpointed int         // txs already in db-file
+	Dropped      []DroppedTx // txs not replayed
+	Corrupted    int         // corrupted records
+	SkippedBytes int64       // bytes not replayed because of corruption
+	Truncated    bool        // the last tx was torn
+	MissingFrom  uint64      // first lsn of a missing part of the wal (0 if none)
+
+	// restore
+	AfterTarget         int  // committed txs after the recovery target
+	SnapshotAfterTarget bool // db-file already contains a tx after the target
+}
+
+type DroppedTx struct {
+	Ts      uint64 // 0 if the begin record is lost
+	Segment string
+	Offset  int64 // offset of the begin record in the segment
+	Reason  string
+}
+
+func (r *RecoveryReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "recovered %v tx(s) up to lsn %v (ts %v)", r.Committed, r.LastLSN, r.LastTs)
+	if r.Checkpointed > 0 {
+		fmt.Fprintf(&b, ", %v tx(s) already checkpointed", r.Checkpointed)
+	}
+	if r.Corrupted > 0 {
+		fmt.Fprintf(&b, ", %v corrupted record(s), %v byte(s) skipped", r.Corrupted, r.SkippedBytes)
+	}
+	if r.Truncated {
+		b.WriteString(", torn tail")
+	}
+	if r.MissingFrom > 0 {
+		fmt.Fprintf(&b, ", wal is missing from lsn %v", r.MissingFrom)
+	}
+	if r.AfterTarget > 0 {
+		fmt.Fprintf(&b, ", %v tx(s) after the recovery target", r.AfterTarget)
+	}
+	for _, tx := range r.Dropped {
+		fmt.Fprintf(&b, "\n  dropped tx (ts: %v, segment: %v, offset: %v): %v", tx.Ts, tx.Segment, tx.Offset, tx.Reason)
+	}
+	return b.String()
+}
+
+func (db *DB) loadWal() *RecoveryReport {
+	return db.replayWal(db.wal.log.list())
+}
+
+// replayWal replays the committed txs in segments which are not in db-file
+// (and not after db.target).
+func (db *DB) replayWal(segments []segment) *RecoveryReport {
+	report := &RecoveryReport{}
+
+	// commit record まで読めた tx だけを db-memory に反映する
+	var begin *walRecord
+	var operations []*Operation
+	txSegment := ""       // 読みかけの tx (または壊れた record) の segment
+	txOffset := int64(-1) // と位置
+	broken := false
+	drop := func(ts uint64) {
+		reason := "commit record is missing"
+		if broken {
+			reason = "checksum mismatch"
+		}
+		report.Dropped = append(report.Dropped, DroppedTx{Ts: ts, Segment: txSegment, Offset: txOffset, Reason: reason})
+	}
+	reset := func() {
+		begin = nil
+		operations = nil
+		txSegment = ""
+		txOffset = -1
+		broken = false
+	}
+	corrupted := func(segment string, offset int64) {
+		report.Corrupted++
+		if txOffset < 0 {
+			txSegment = segment
+			txOffset = offset
+		}
+		broken = true
+	}
+
+segments:
+	for i, seg := range segments {
+		// segment は前の segment (最初なら db-file) の続きから始まる
+		expected := db.checkpointLSN + 1
+		if i > 0 {
+			expected = report.LastLSN + 1
+		}
+		if seg.firstLSN > expected && report.Corrupted == 0 {
+			if report.MissingFrom == 0 {
+				report.MissingFrom = expected
+			}
+			// 間の segment が無いので読みかけの tx は揃っていない
+			if begin != nil || broken {
+				var ts uint64
+				if begin != nil {
+					ts = begin.ts
+				}
+				drop(ts)
+				reset()
+			}
+			// 壊れた record と同じく、stop ならこれより後を replay しない
+			if db.opts.RecoveryPolicy == StopAtCorruption {
+				break
+			}
+		}
+		file, format, err := openSegment(db.fs, seg.path, db.opts.Keys)
+		if err == errTornSegment && i == len(segments)-1 {
+			report.Truncated = true
+			break
+		}
+		if err == errBrokenSegment || err == errTornSegment {
+			corrupted(seg.path, 0)
+			if db.opts.RecoveryPolicy == StopAtCorruption {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			log.Println("cannot do crash recovery:", err)
+			break
+		}
+		reader, err := newWALReader(file, format)
+		if err != nil {
+			file.Close()
+			log.Println("cannot do crash recovery:", err)
+			break
+		}
+
+		for {
+			offset := reader.offset
+			rec, err := reader.next()
+			if err == io.ErrUnexpectedEOF && i == len(segments)-1 { // 最後の書き込みが途中で切れた
+				report.Truncated = true
+				break
+			}
+			if err == errChecksum || err == errBrokenRecord || err == io.ErrUnexpectedEOF {
+				corrupted(seg.path, offset)
+				if db.opts.RecoveryPolicy == StopAtCorruption {
+					report.SkippedBytes = reader.size - offset
+					file.Close()
+					break segments
+				}
+				if reader.offset == offset { // record の境界が分からない
+					if err := reader.resync(offset); err != nil && err != io.EOF {
+						log.Println("cannot do crash recovery:", err)
+					}
+				}
+				report.SkippedBytes += reader.offset - offset
+				continue
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Println("cannot do crash recovery:", err)
+				}
+				break
+			}
+
+			if rec.lsn > report.LastLSN {
+				report.LastLSN = rec.lsn
+			}
+			if rec.ts > report.LastTs {
+				report.LastTs = rec.ts
+			}
+			switch rec.typ {
+			case recBegin:
+				if begin != nil || broken {
+					var ts uint64
+					if begin != nil {
+						ts = begin.ts
+					}
+					drop(ts)
+					reset()
+				}
+				begin = rec
+				txSegment = seg.path
+				txOffset = offset
+			case recOperation:
+				if begin == nil { // begin record が読めなかった
+					continue
+				}
+				operations = append(operations, rec.op)
+			case recCommit:
+				if begin == nil || broken {
+					drop(rec.ts)
+				} else if begin.ts != rec.ts || int(begin.opCount) != len(operations) {
+					broken = true
+					drop(rec.ts)
+				} else if rec.lsn <= db.checkpointLSN || rec.ts <= db.checkpointTs { // db-file に含まれている
+					report.Checkpointed++
+					if !db.target.includes(rec.lsn, rec.ts) {
+						report.SnapshotAfterTarget = true
+					}
+				} else if !db.target.includes(rec.lsn, rec.ts) { // restore の対象外
+					report.AfterTarget++
+				} else {
+					db.redo(rec.ts, operations)
+					report.Committed++
+				}
+				reset()
+			}
+		}
+		file.Close()
+	}
+
+	if begin != nil {
+		drop(begin.ts)
+	} else if broken {
+		drop(0)
+	}
+	return report
+}
+
+// redo applies operations of a committed tx to db-memory. The versions keep
+// the ts of the tx.
+func (db *DB) redo(ts uint64, operations []*Operation) {
+	for _, op := range operations {
+		op.version.wTs = ts
+		op.version.rTs = ts
+		switch op.cmd {
+		case INSERT:
+			record := Record{
+				key:  op.version.key,
+				last: op.version,
+			}
+			db.index.Store(op.version.key, &record)
+		case UPDATE:
+			record := Record{
+				key:  op.version.key,
+				last: op.version,
+			}
+			db.index.Store(op.version.key, &record)
+		case DELETE:
+			db.index.Delete(op.version.key)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// committed(1) corrupted(2) committed2(3) torn(4)
+func generateCorruptedWal(dir string) {
+	buf := new(bytes.Buffer)
+	tw := &testWalWriter{w: buf}
+	tw.writeTx(1, &Operation{INSERT, &Version{"committed", "value", 0, 0, nil, false}})
+
+	// checksum mismatch
+	tw.writeTx(2, &Operation{INSERT, &Version{"corrupted", "value", 0, 0, nil, false}})
+	buf.Bytes()[buf.Len()-20] ^= 0xff
+	tw.writeTx(3, &Operation{INSERT, &Version{"committed2", "value", 0, 0, nil, false}})
+
+	// torn write (commit record is missing)
+	before := buf.Len()
+	tw.writeTx(4, &Operation{INSERT, &Version{"torn", strings.Repeat("v", WALPageSize), 0, 0, nil, false}})
+	buf.Truncate(before + WALPageSize)
+
+	writeTestWal(dir, buf.Bytes())
+}
+
+func TestDB_LoadWal_SkipTransaction(t *testing.T) {
+	dir := t.TempDir()
+	generateCorruptedWal(dir)
+	db := OpenTestDB(dir)
+	defer db.close()
+	db.opts.RecoveryPolicy = SkipTransaction
+
+	report := db.loadWal()
+	for _, key := range []string{"committed", "committed2"} {
+		if _, exist := db.index.Load(key); !exist {
+			t.Errorf("committed tx is lost: %v", key)
+		}
+	}
+	for _, key := range []string{"corrupted", "torn"} {
+		if _, exist := db.index.Load(key); exist {
+			t.Errorf("uncommitted tx is recovered: %v", key)
+		}
+	}
+	if report.Committed != 2 || report.Corrupted != 1 || !report.Truncated || len(report.Dropped) != 2 {
+		t.Errorf("wrong report: %v", report)
+	}
+	if report.Dropped[0].Ts != 2 || report.Dropped[1].Ts != 4 {
+		t.Errorf("wrong dropped tx: %v", report)
+	}
+}
+
+func TestDB_LoadWal_StopAtCorruption(t *testing.T) {
+	dir := t.TempDir()
+	generateCorruptedWal(dir)
+	db := OpenTestDB(dir)
+	defer db.close()
+
+	report := db.loadWal()
+	if _, exist := db.index.Load("committed"); !exist {
+		t.Error("committed tx is lost")
+	}
+	for _, key := range []string{"corrupted", "committed2", "torn"} {
+		if _, exist := db.index.Load(key); exist {
+			t.Errorf("tx after corruption is recovered: %v", key)
+		}
+	}
+	if report.Committed != 1 || report.Corrupted != 1 || report.SkippedBytes == 0 || len(report.Dropped) != 1 {
+		t.Errorf("wrong report: %v", report)
+	}
+}
+
+func TestDB_LoadWal_Resync(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := &testWalWriter{w: buf}
+	tw.writeTx(1, &Operation{INSERT, &Version{"key1", "value1", 0, 0, nil, false}})
+	broken := buf.Len()
+	tw.writeTx(2, &Operation{INSERT, &Version{"key2", "value2", 0, 0, nil, false}})
+	tw.writeTx(3, &Operation{INSERT, &Version{"key3", "value3", 0, 0, nil, false}})
+	// size of the begin record of tx 2
+	copy(buf.Bytes()[broken:], []byte{0xff, 0xff, 0xff, 0xff})
+
+	dir := t.TempDir()
+	writeTestWal(dir, buf.Bytes())
+	db := OpenTestDB(dir)
+	defer db.close()
+	db.opts.RecoveryPolicy = SkipTransaction
+
+	report := db.loadWal()
+	for _, key := range []string{"key1", "key3"} {
+		if _, exist := db.index.Load(key); !exist {
+			t.Errorf("committed tx is lost: %v", key)
+		}
+	}
+	if _, exist := db.index.Load("key2"); exist {
+		t.Error("broken tx is recovered")
+	}
+	if report.Committed != 2 || len(report.Dropped) != 1 || report.Dropped[0].Ts != 2 {
+		t.Errorf("wrong report: %v", report)
+	}
+}
+
+func TestDB_LoadWal_Checkpointed(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := &testWalWriter{w: buf}
+	tw.writeTx(1, &Operation{INSERT, &Version{"key1", "value1", 0, 0, nil, false}})
+	tw.writeTx(2, &Operation{INSERT, &Version{"key2", "value2", 0, 0, nil, false}})
+	dir := t.TempDir()
+	writeTestWal(dir, buf.Bytes())
+	db := OpenTestDB(dir)
+	defer db.close()
+
+	// tx 1 (lsn 1-3) is in db-file
+	db.checkpointLSN = 3
+	report := db.loadWal()
+	if _, exist := db.index.Load("key1"); exist {
+		t.Error("checkpointed tx is replayed")
+	}
+	if _, exist := db.index.Load("key2"); !exist {
+		t.Error("committed tx is lost")
+	}
+	if report.Committed != 1 || report.Checkpointed != 1 || report.LastLSN != 6 {
+		t.Errorf("wrong report: %v", report)
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RESP (Redis serialization protocol) front end
+// request は bulk string の array か、空白で区切った 1 行 (inline command)
+// GET/SET/DEL/EXISTS はそれぞれ 1 つの tx で、MULTI から EXEC までは 1 つの tx で実行する
+// EXEC は WATCH した key の最新の version が変わっているか、commit が他の tx と衝突すると
+// null を返す (client は retry する)
+const (
+	DefaultRESPAddr   = ":7779"
+	respReadBufSize   = 64 << 10 // inline command の最大長
+	maxRESPArgs       = 1 << 20
+	respServerVersion = "1.0.0"
+)
+
+var errRESPProtocol = errors.New("Protocol error")
+
+// respCommands are the commands run in a tx and their arity (including the
+// command name, negative means at least).
+var respCommands = map[string]int{
+	"GET":    2,
+	"SET":    -3,
+	"DEL":    -2,
+	"EXISTS": -2,
+	"PING":   -1,
+	"ECHO":   2,
+}
+
+// readRESPCommand reads the arguments of a command. An empty line returns no
+// arguments.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxRESPArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	var args []string
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > MaxFrameSize {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string is not terminated by CRLF", errRESPProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("%w: too big inline request", errRESPProtocol)
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// respWriter writes replies in RESP2 or RESP3.
+type respWriter struct {
+	w     io.Writer
+	proto int
+}
+
+func (w *respWriter) simple(s string) {
+	fmt.Fprintf(w.w, "+%s\r\n", s)
+}
+
+func (w *respWriter) errorReply(s string) {
+	fmt.Fprintf(w.w, "-%s\r\n", s)
+}
+
+func (w *respWriter) integer(n int) {
+	fmt.Fprintf(w.w, ":%d\r\n", n)
+}
+
+func (w *respWriter) bulk(s string) {
+	fmt.Fprintf(w.w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w *respWriter) array(n int) {
+	fmt.Fprintf(w.w, "*%d\r\n", n)
+}
+
+// mapHeader starts a map of n pairs (a flat array in RESP2).
+func (w *respWriter) mapHeader(n int) {
+	if w.proto == 3 {
+		fmt.Fprintf(w.w, "%%%d\r\n", n)
+	} else {
+		w.array(2 * n)
+	}
+}
+
+func (w *respWriter) null() {
+	if w.proto == 3 {
+		io.WriteString(w.w, "_\r\n")
+	} else {
+		io.WriteString(w.w, "$-1\r\n")
+	}
+}
+
+func (w *respWriter) nullArray() {
+	if w.proto == 3 {
+		io.WriteString(w.w, "_\r\n")
+	} else {
+		io.WriteString(w.w, "*-1\r\n")
+	}
+}
+
+// respError returns the error reply of err, whose first word is the error
+// code as in Redis.
+func respError(err error) string {
+	switch errorCode(err) {
+	case ErrCodeConflict:
+		return "CONFLICT " + err.Error()
+	case ErrCodeReadOnly:
+		return "READONLY " + err.Error()
+	}
+	return "ERR " + err.Error()
+}
+
+// checkRESPCommand returns the error reply if args is not a command run in a
+// tx or has a wrong number of arguments.
+func checkRESPCommand(args []string) string {
+	arity, exist := respCommands[strings.ToUpper(args[0])]
+	if !exist {
+		return fmt.Sprintf("ERR unknown command '%v'", args[0])
+	}
+	if (arity > 0 && len(args) != arity) || (arity < 0 && len(args) < -arity) {
+		return fmt.Sprintf("ERR wrong number of arguments for '%v' command", strings.ToLower(args[0]))
+	}
+	return ""
+}
+
+// runRESPCommand runs a command checked by checkRESPCommand in tx and writes
+// its reply.
+func runRESPCommand(tx *Tx, args []string, w *respWriter) {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		if len(args) > 1 {
+			w.bulk(args[1])
+		} else {
+			w.simple("PONG")
+		}
+	case "ECHO":
+		w.bulk(args[1])
+	case "GET":
+		value, err := tx.Read(args[1])
+		if errors.Is(err, errKeyNotExist) {
+			w.null()
+			return
+		}
+		if err != nil {
+			w.errorReply(respError(err))
+			return
+		}
+		w.bulk(value)
+	case "EXISTS":
+		n := 0
+		for _, key := range args[1:] {
+			if _, err := tx.Read(key); err == nil {
+				n++
+			}
+		}
+		w.integer(n)
+	case "DEL":
+		n := 0
+		deleted := make(map[string]bool)
+		for _, key := range args[1:] {
+			if deleted[key] {
+				continue
+			}
+			if _, err := tx.Read(key); err != nil {
+				continue
+			}
+			if err := tx.Delete(key); err != nil {
+				w.errorReply(respError(err))
+				return
+			}
+			deleted[key] = true
+			n++
+		}
+		w.integer(n)
+	case "SET":
+		runRESPSet(tx, args, w)
+	}
+}
+
+// runRESPSet runs SET key value [NX|XX] as Insert or Update.
+func runRESPSet(tx *Tx, args []string, w *respWriter) {
+	key, value := args[1], args[2]
+	var nx, xx bool
+	for _, opt := range args[3:] {
+		switch strings.ToUpper(opt) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			w.errorReply("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		w.errorReply("ERR syntax error")
+		return
+	}
+
+	_, err := tx.Read(key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, errKeyNotExist) {
+		w.errorReply(respError(err))
+		return
+	}
+	if (nx && exists) || (xx && !exists) {
+		w.null()
+		return
+	}
+	if exists {
+		err = tx.Update(key, value)
+	} else {
+		err = tx.Insert(key, value)
+	}
+	if err != nil {
+		w.errorReply(respError(err))
+		return
+	}
+	w.simple("OK")
+}
+
+// lastVersion returns the latest committed version of key, or nil if it does
+// not exist.
+func (db *DB) lastVersion(key string) *Version {
+	v, exist := db.index.Load(key)
+	if !exist {
+		return nil
+	}
+	record := v.(*Record)
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	if record.last.deleted {
+		return nil
+	}
+	return record.last
+}
+
+type respSession struct {
+	db      *DB
+	w       *respWriter
+	multi   bool
+	queued  [][]string
+	dirty   bool                // a command was rejected after MULTI
+	watched map[string]*Version // the latest versions at WATCH
+}
+
+// ServeRESP runs the commands sent on conn in RESP2 (or RESP3 after HELLO 3)
+// until the connection is closed.
+func (db *DB) ServeRESP(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, respReadBufSize)
+	writer := bufio.NewWriter(conn)
+	s := &respSession{db: db, w: &respWriter{w: writer, proto: 2}}
+
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				s.w.errorReply("ERR " + err.Error())
+				writer.Flush()
+			} else if err != io.EOF {
+				log.Println("resp:", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.handle(args)
+		// pipeline された command の reply はまとめて送る
+		if quit || reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handle runs a command and writes its reply. It returns true on QUIT.
+func (s *respSession) handle(args []string) bool {
+	name := strings.ToUpper(args[0])
+	if s.multi {
+		switch name {
+		case "EXEC":
+			s.exec()
+		case "DISCARD":
+			s.reset()
+			s.w.simple("OK")
+		case "MULTI":
+			s.w.errorReply("ERR MULTI calls can not be nested")
+		case "WATCH":
+			s.w.errorReply("ERR WATCH inside MULTI is not allowed")
+		case "QUIT":
+			s.w.simple("OK")
+			return true
+		default:
+			if reply := checkRESPCommand(args); reply != "" {
+				s.dirty = true
+				s.w.errorReply(reply)
+				return false
+			}
+			s.queued = append(s.queued, args)
+			s.w.simple("QUEUED")
+		}
+		return false
+	}
+
+	switch name {
+	case "QUIT":
+		s.w.simple("OK")
+		return true
+	case "HELLO":
+		s.hello(args)
+	case "SELECT":
+		if len(args) != 2 {
+			s.w.errorReply("ERR wrong number of arguments for 'select' command")
+		} else if args[1] != "0" {
+			s.w.errorReply("ERR DB index is out of range")
+		} else {
+			s.w.simple("OK")
+		}
+	case "CLIENT":
+		// client library が接続時に送る名前などは受け取るだけ
+		if len(args) >= 2 && (strings.ToUpper(args[1]) == "SETNAME" || strings.ToUpper(args[1]) == "SETINFO") {
+			s.w.simple("OK")
+		} else {
+			s.w.errorReply("ERR unsupported CLIENT subcommand")
+		}
+	case "COMMAND":
+		s.w.array(0)
+	case "MULTI":
+		s.multi = true
+		s.w.simple("OK")
+	case "EXEC":
+		s.w.errorReply("ERR EXEC without MULTI")
+	case "DISCARD":
+		s.w.errorReply("ERR DISCARD without MULTI")
+	case "WATCH":
+		if len(args) < 2 {
+			s.w.errorReply("ERR wrong number of arguments for 'watch' command")
+			return false
+		}
+		if s.watched == nil {
+			s.watched = make(map[string]*Version)
+		}
+		for _, key := range args[1:] {
+			if _, exist := s.watched[key]; !exist {
+				s.watched[key] = s.db.lastVersion(key)
+			}
+		}
+		s.w.simple("OK")
+	case "UNWATCH":
+		s.watched = nil
+		s.w.simple("OK")
+	default:
+		if reply := checkRESPCommand(args); reply != "" {
+			s.w.errorReply(reply)
+			return false
+		}
+		s.run([][]string{args}, nil, false)
+	}
+	return false
+}
+
+// hello runs HELLO [protover [AUTH username password] [SETNAME name]].
+func (s *respSession) hello(args []string) {
+	proto := s.w.proto
+	if len(args) >= 2 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil || (version != 2 && version != 3) {
+			s.w.errorReply("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = version
+	}
+	s.w.proto = proto
+	s.w.mapHeader(7)
+	s.w.bulk("server")
+	s.w.bulk("seccampdb")
+	s.w.bulk("version")
+	s.w.bulk(respServerVersion)
+	s.w.bulk("proto")
+	s.w.integer(proto)
+	s.w.bulk("id")
+	s.w.integer(0)
+	s.w.bulk("mode")
+	s.w.bulk("standalone")
+	s.w.bulk("role")
+	s.w.bulk("master")
+	s.w.bulk("modules")
+	s.w.array(0)
+}
+
+func (s *respSession) reset() {
+	s.multi = false
+	s.queued = nil
+	s.dirty = false
+	s.watched = nil
+}
+
+func (s *respSession) exec() {
+	queued, dirty, watched := s.queued, s.dirty, s.watched
+	s.reset()
+	if dirty {
+		s.w.errorReply("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+	s.run(queued, watched, true)
+}
+
+// run runs commands in one tx unless a watched key has been changed. The
+// replies are written if the tx commits, as an array if multi.
+func (s *respSession) run(commands [][]string, watched map[string]*Version, multi bool) {
+	tx := NewTx(s.db)
+	defer tx.DestructTx()
+
+	// watch した key を tx で読んで rTs を付けてから確かめるので、これより後に
+	// 書く古い tx は commit で衝突する (queue の command が読まない key も)
+	for key, version := range watched {
+		tx.Read(key) // 無い key も読めば placeholder が index に入る
+		if s.db.lastVersion(key) != version {
+			s.w.nullArray()
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	replies := &respWriter{w: &buf, proto: s.w.proto}
+	for _, args := range commands {
+		runRESPCommand(tx, args, replies)
+	}
+	if _, err := tx.Commit(); err != nil {
+		if multi && errors.Is(err, errCommitFailed) {
+			s.w.nullArray()
+		} else {
+			s.w.errorReply(respError(err))
+		}
+		return
+	}
+	if multi {
+		s.w.array(len(commands))
+	}
+	s.w.w.Write(buf.Bytes())
+}
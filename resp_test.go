@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type respErrorReply string
+
+// respConn sends commands to DB.ServeRESP.
+type respConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRESPConn(t *testing.T, db *DB) *respConn {
+	client, server := net.Pipe()
+	go db.ServeRESP(server)
+	t.Cleanup(func() { client.Close() })
+	return &respConn{t: t, conn: client, reader: bufio.NewReader(client)}
+}
+
+// do sends a command as an array of bulk strings and returns the reply:
+// string, int, respErrorReply, nil or []interface{}.
+func (c *respConn) do(args ...string) interface{} {
+	c.t.Helper()
+	buf := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		buf += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return c.send(buf)
+}
+
+func (c *respConn) send(request string) interface{} {
+	c.t.Helper()
+	go c.conn.Write([]byte(request))
+	reply, err := c.read()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return reply
+}
+
+func (c *respConn) read() (interface{}, error) {
+	line, err := readRESPLine(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respErrorReply(line[1:]), nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '_':
+		return nil, nil
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil, nil
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		array := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			reply, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, reply)
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("unknown reply: %q", line)
+}
+
+func TestServeRESP(t *testing.T) {
+	db := newTempDB(t, Options{})
+	c := newRESPConn(t, db)
+
+	tests := []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"GET", "key"}, nil},
+		{[]string{"SET", "key", "value with spaces\r\n"}, "OK"},
+		{[]string{"GET", "key"}, "value with spaces\r\n"},
+		{[]string{"SET", "key", "new"}, "OK"},
+		{[]string{"SET", "key", "x", "NX"}, nil},
+		{[]string{"SET", "other", "x", "XX"}, nil},
+		{[]string{"get", "key"}, "new"},
+		{[]string{"SET", "key2", "value2"}, "OK"},
+		{[]string{"EXISTS", "key", "key2", "key3"}, 2},
+		{[]string{"DEL", "key", "key", "key3"}, 1},
+		{[]string{"EXISTS", "key"}, 0},
+		{[]string{"GET"}, respErrorReply("ERR wrong number of arguments for 'get' command")},
+		{[]string{"FLUSHALL"}, respErrorReply("ERR unknown command 'FLUSHALL'")},
+		{[]string{"EXEC"}, respErrorReply("ERR EXEC without MULTI")},
+	}
+	for _, tt := range tests {
+		if got := c.do(tt.args...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %#v, want %#v", tt.args, got, tt.want)
+		}
+	}
+
+	// inline command (telnet, redis-cli)
+	if got := c.send("GET key2\r\n"); got != "value2" {
+		t.Errorf("inline: got %#v", got)
+	}
+
+	// RESP3 では null が _ になる
+	if got := c.do("HELLO", "3"); !reflect.DeepEqual(got.([]interface{})[:6], []interface{}{"server", "seccampdb", "version", respServerVersion, "proto", 3}) {
+		t.Errorf("hello: got %#v", got)
+	}
+	if got := c.send("GET nothing\r\n"); got != nil {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestServeRESP_Multi(t *testing.T) {
+	db := newTempDB(t, Options{})
+	c := newRESPConn(t, db)
+	c.do("SET", "key1", "1")
+
+	for _, tt := range []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"GET", "key1"}, "QUEUED"},
+		{[]string{"SET", "key1", "2"}, "QUEUED"},
+		{[]string{"SET", "key2", "3"}, "QUEUED"},
+		{[]string{"DEL", "key1"}, "QUEUED"},
+		{[]string{"EXEC"}, []interface{}{"1", "OK", "OK", 1}},
+		{[]string{"EXISTS", "key1", "key2"}, 1},
+
+		// 間違った command があれば何もしない
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"SET", "key2", "4"}, "QUEUED"},
+		{[]string{"GET"}, respErrorReply("ERR wrong number of arguments for 'get' command")},
+		{[]string{"EXEC"}, respErrorReply("EXECABORT Transaction discarded because of previous errors.")},
+		{[]string{"GET", "key2"}, "3"},
+
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"SET", "key2", "5"}, "QUEUED"},
+		{[]string{"DISCARD"}, "OK"},
+		{[]string{"GET", "key2"}, "3"},
+	} {
+		if got := c.do(tt.args...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %#v, want %#v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestServeRESP_Watch(t *testing.T) {
+	db := newTempDB(t, Options{})
+	c1 := newRESPConn(t, db)
+	c2 := newRESPConn(t, db)
+	c1.do("SET", "counter", "1")
+
+	// 他の connection が WATCH した key を書き換えると EXEC は null を返す
+	c1.do("WATCH", "counter")
+	c2.do("SET", "counter", "2")
+	c1.do("MULTI")
+	c1.do("SET", "counter", "10")
+	if got := c1.do("EXEC"); got != nil {
+		t.Errorf("exec after a change: got %#v", got)
+	}
+	if got := c1.do("GET", "counter"); got != "2" {
+		t.Errorf("got %#v", got)
+	}
+
+	// 変わっていなければ実行する
+	c1.do("WATCH", "counter", "missing")
+	c1.do("MULTI")
+	c1.do("SET", "counter", "3")
+	if got := c1.do("EXEC"); !reflect.DeepEqual(got, []interface{}{"OK"}) {
+		t.Errorf("exec: got %#v", got)
+	}
+	if got := c2.do("GET", "counter"); got != "3" {
+		t.Errorf("got %#v", got)
+	}
+
+	// EXEC より前に始まった tx が watch した key を後から書くと衝突する
+	older := NewTx(db)
+	defer older.DestructTx()
+	c1.do("WATCH", "counter")
+	c1.do("MULTI")
+	c1.do("SET", "other", "1")
+	if got := c1.do("EXEC"); !reflect.DeepEqual(got, []interface{}{"OK"}) {
+		t.Errorf("exec: got %#v", got)
+	}
+	if err := older.Update("counter", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := older.Commit(); !errors.Is(err, errCommitFailed) {
+		t.Errorf("commit of a write to a watched key after exec: %v", err)
+	}
+}
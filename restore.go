@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+)
+
+var errNoRestorePoint = errors.New("no archived db-file and wal to restore from")
+
+// RecoveryTarget is the point a restore stops at. A zero field means no limit.
+type RecoveryTarget struct {
+	UntilTs  uint64 // replay the txs whose ts is not larger than UntilTs
+	UntilLSN uint64 // replay the txs whose commit record is not after UntilLSN
+}
+
+func (t *RecoveryTarget) includes(lsn, ts uint64) bool {
+	if t == nil {
+		return true
+	}
+	if t.UntilTs > 0 && ts > t.UntilTs {
+		return false
+	}
+	if t.UntilLSN > 0 && lsn > t.UntilLSN {
+		return false
+	}
+	return true
+}
+
+func (t *RecoveryTarget) String() string {
+	switch {
+	case t.UntilTs > 0 && t.UntilLSN > 0:
+		return fmt.Sprintf("ts %v and lsn %v", t.UntilTs, t.UntilLSN)
+	case t.UntilTs > 0:
+		return fmt.Sprintf("ts %v", t.UntilTs)
+	default:
+		return fmt.Sprintf("lsn %v", t.UntilLSN)
+	}
+}
+
+// archiveSnapshot copies db-file to the archive dir as <db-file>.<lsn>.
+func (db *DB) archiveSnapshot(lsn uint64) error {
+	if err := db.fs.MkdirAll(db.opts.ArchiveDir, 0777); err != nil {
+		return err
+	}
+	dst := segmentPath(filepath.Join(db.opts.ArchiveDir, filepath.Base(db.dbFileName)), lsn)
+	if err := copyFile(db.fs, db.dbFileName, dst+".tmp"); err != nil {
+		return err
+	}
+	if err := db.fs.Rename(dst+".tmp", dst); err != nil {
+		return err
+	}
+	return db.fs.SyncDir(db.opts.ArchiveDir)
+}
+
+// restoreSegments returns the archived and the current wal segments.
+func restoreSegments(fs FileSystem, walFileName, archiveDir string) ([]segment, error) {
+	archived, err := listSegments(fs, filepath.Join(archiveDir, filepath.Base(walFileName)))
+	if err != nil {
+		return nil, err
+	}
+	current, err := listSegments(fs, walFileName)
+	if err != nil {
+		return nil, err
+	}
+	// 同じ segment が両方にあれば今の方を使う
+	byLSN := make(map[uint64]segment)
+	for _, seg := range append(archived, current...) {
+		byLSN[seg.firstLSN] = seg
+	}
+	segments := make([]segment, 0, len(byLSN))
+	for _, seg := range byLSN {
+		segments = append(segments, seg)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstLSN < segments[j].firstLSN
+	})
+	return segments, nil
+}
+
+// Restore writes db-file as of target to outFileName, using the db-files and
+// wal segments in opts.ArchiveDir (and the current wal). The newest archived
+// db-file which contains no tx after target is loaded and the wal is replayed
+// from there.
+//
+// The restored db-file covers every wal record read, so starting the DB with
+// it does not replay the txs after target again.
+func Restore(walFileName, dbFileName, outFileName string, opts Options, target *RecoveryTarget) (*RecoveryReport, error) {
+	fs := opts.fileSystem()
+	segments, err := restoreSegments(fs, walFileName, opts.ArchiveDir)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := listSegments(fs, filepath.Join(opts.ArchiveDir, filepath.Base(dbFileName)))
+	if err != nil {
+		return nil, err
+	}
+
+	// 新しい db-file から試し、最後は空の状態から wal を全て replay する
+	for i := len(snapshots) - 1; i >= -1; i-- {
+		path := ""
+		if i >= 0 {
+			path = snapshots[i].path
+			if target.UntilLSN > 0 && snapshots[i].firstLSN > target.UntilLSN {
+				continue
+			}
+		}
+		// 次の db-file までの wal が無ければ target まで戻せない
+		var next uint64
+		if i+1 < len(snapshots) {
+			next = snapshots[i+1].firstLSN
+		}
+		report, err := restoreFrom(path, next, segments, walFileName, outFileName, opts, target)
+		if err == errNoRestorePoint {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return report, nil
+	}
+	return nil, errNoRestorePoint
+}
+
+// restoreFrom restores db-file from the archived db-file at path (empty if
+// none), whose wal has to reach at least the lsn of the next archived db-file.
+// It returns errNoRestorePoint if the db-file is after target.
+func restoreFrom(path string, next uint64, segments []segment, walFileName, dbFileName string, opts Options, target *RecoveryTarget) (*RecoveryReport, error) {
+	opts.ArchiveDir = "" // restore の結果は archive しない
+	db := NewDB(walFileName, dbFileName, opts)
+	defer db.close()
+	db.target = target
+
+	if path != "" {
+		file, err := openFile(db.fs, path)
+		if err != nil {
+			return nil, err
+		}
+		err = db.loadSnapshot(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		if !target.includes(0, db.checkpointTs) {
+			return nil, errNoRestorePoint
+		}
+	}
+
+	if err := checkSegmentKeys(db.fs, segments, opts.Keys); err != nil {
+		return nil, err
+	}
+	report := db.replayWal(segments)
+	if report.SnapshotAfterTarget {
+		return nil, errNoRestorePoint
+	}
+	lsn := db.checkpointLSN
+	if report.LastLSN > lsn {
+		lsn = report.LastLSN
+	}
+	if report.MissingFrom == 0 && lsn < next {
+		report.MissingFrom = lsn + 1
+	}
+	if report.MissingFrom > 0 {
+		if path == "" {
+			path = "the beginning"
+		}
+		return nil, fmt.Errorf("cannot restore from %v: wal is missing from lsn %v", path, report.MissingFrom)
+	}
+
+	// 読んだ wal は全て db-file に含まれていることにする
+	ts := db.checkpointTs
+	if report.LastTs > ts {
+		ts = report.LastTs
+	}
+	if err := db.saveData(ts, lsn); err != nil {
+		return nil, err
+	}
+	if path != "" {
+		log.Println("restored from", path)
+	}
+	return report, nil
+}
+
+// restoreCommand runs `seccampdb restore`.
+func restoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	untilTs := flags.Uint64("until-ts", 0, "restore the txs whose ts is not larger than this")
+	untilLSN := flags.Uint64("until-lsn", 0, "restore the txs committed up to this lsn")
+	archiveDir := flags.String("archive-dir", "", "directory of the archived db-files and wal segments")
+	dataDir := flags.String("data-dir", ".", "directory of db-file and the wal (the server must be stopped)")
+	out := flags.String("out", "", "db-file to write (default: db-file in -data-dir)")
+	recoveryPolicy := flags.String("recovery", "stop", "what to do with a corrupted WAL record (stop, skip)")
+	backupDir := flags.String("backup", "", "restore from this (full or incremental) backup instead")
+	keys := addKeyFlags(flags)
+	flags.Parse(args)
+
+	opts := Options{ArchiveDir: *archiveDir}
+	var target *RecoveryTarget
+	if *untilTs > 0 || *untilLSN > 0 {
+		target = &RecoveryTarget{UntilTs: *untilTs, UntilLSN: *untilLSN}
+	}
+	if *backupDir == "" {
+		if target == nil {
+			log.Fatal("restore: -until-ts or -until-lsn is required")
+		}
+		if *archiveDir == "" {
+			log.Fatal("restore: -archive-dir is required")
+		}
+	}
+	var err error
+	if opts.RecoveryPolicy, err = ParseRecoveryPolicy(*recoveryPolicy); err != nil {
+		log.Fatal(err)
+	}
+	if opts.Keys, err = keys.load(); err != nil {
+		log.Fatal("restore: ", err)
+	}
+
+	// server が動いていれば lock が取れない
+	dir, err := OpenDataDir(*dataDir)
+	if err != nil {
+		log.Fatal("restore: ", err)
+	}
+	if *out == "" {
+		*out = dir.DBFileName()
+	}
+	var report *RecoveryReport
+	if *backupDir != "" {
+		report, err = RestoreBackup(*backupDir, dir.WALFileName(), *out, opts, target)
+	} else {
+		report, err = Restore(dir.WALFileName(), dir.DBFileName(), *out, opts, target)
+	}
+	dir.Close()
+	if err != nil {
+		log.Fatal("restore: ", err)
+	}
+	log.Println(report)
+	if *backupDir != "" {
+		fmt.Printf("restored %v from %v\n", *out, *backupDir)
+	} else {
+		fmt.Printf("restored %v to %v\n", *out, target)
+	}
+}
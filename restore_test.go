@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	walFileName := filepath.Join(dir, "seccampdb.log")
+	dbFileName := filepath.Join(dir, "seccampdb.db")
+	opts := Options{SegmentSize: 256, ArchiveDir: filepath.Join(dir, "archive")}
+	db := NewDB(walFileName, dbFileName, opts)
+	db.Setup()
+
+	write := func(key, value string) uint64 {
+		tx := NewTx(db)
+		defer tx.DestructTx()
+		if err := tx.Insert(key, value); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		return tx.ts
+	}
+	ts1 := write("key1", "value1")
+	if err := db.checkpoint(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	ts2 := write("key2", "value2")
+	lsn2 := db.DurableLSN()
+	if err := db.checkpoint(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	write("key3", "value3") // 間違った書き込み
+	db.close()
+
+	tests := []struct {
+		name   string
+		target *RecoveryTarget
+		want   []string
+	}{
+		{"before 1st checkpoint", &RecoveryTarget{UntilTs: ts1}, []string{"key1"}},
+		{"before 2nd checkpoint", &RecoveryTarget{UntilTs: ts2}, []string{"key1", "key2"}},
+		{"lsn", &RecoveryTarget{UntilLSN: lsn2}, []string{"key1", "key2"}},
+		{"latest", &RecoveryTarget{UntilTs: ts2 + 100}, []string{"key1", "key2", "key3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(dir, "restored.db")
+			os.Remove(out)
+			if _, err := Restore(walFileName, dbFileName, out, opts, tt.target); err != nil {
+				t.Fatalf("failed to restore: %v", err)
+			}
+
+			// 復元した db-file で起動しても target より後の tx は replay されない
+			restored := NewDB(walFileName, out, Options{})
+			defer restored.close()
+			if err := restored.loadData(); err != nil {
+				t.Fatal(err)
+			}
+			if report := restored.loadWal(); report.Committed != 0 {
+				t.Errorf("wal should be covered by restored db-file: %v", report)
+			}
+			n := 0
+			restored.index.Range(func(k, v interface{}) bool {
+				n++
+				return true
+			})
+			if n != len(tt.want) {
+				t.Errorf("wrong number of keys: %v", n)
+			}
+			for _, key := range tt.want {
+				if _, exist := restored.index.Load(key); !exist {
+					t.Errorf("%v is not restored", key)
+				}
+			}
+		})
+	}
+}
+
+func TestRestore_MissingWal(t *testing.T) {
+	dir := t.TempDir()
+	walFileName := filepath.Join(dir, "seccampdb.log")
+	dbFileName := filepath.Join(dir, "seccampdb.db")
+	opts := Options{ArchiveDir: filepath.Join(dir, "archive")}
+	db := NewDB(walFileName, dbFileName, opts)
+	db.Setup()
+	var ts []uint64
+	for _, key := range []string{"key1", "key2"} {
+		tx := NewTx(db)
+		tx.Insert(key, "value")
+		if _, err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		tx.DestructTx()
+		ts = append(ts, tx.ts)
+	}
+	if err := db.checkpoint(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	db.close()
+
+	// archive された wal が無いと checkpoint より前には戻せない
+	segments, err := listSegments(osFS{}, filepath.Join(opts.ArchiveDir, "seccampdb.log"))
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("wal is not archived: %v", err)
+	}
+	for _, seg := range segments {
+		os.Remove(seg.path)
+	}
+	out := filepath.Join(dir, "restored.db")
+	if _, err := Restore(walFileName, dbFileName, out, opts, &RecoveryTarget{UntilTs: ts[0]}); err == nil {
+		t.Errorf("should not be restored: %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WAL segment
+// | magic "SWAL" (4) | version (2) | flags (2) | record | record | ...
+// version 2 は暗号化された segment で、flags の後に key id (8) がある
+// flags の上位 8 bit は record の圧縮の codec
+// file 名は <wal file name>.<最初の record の lsn>
+const (
+	DefaultSegmentSize      = 16 << 20
+	segmentMagic            = "SWAL"
+	segmentVersion          = 1
+	segmentEncryptedVersion = 2
+	segmentHeaderSize       = 8
+	quarantineSuffix        = ".corrupted" // 隔離した segment の file 名の後ろに付ける
+)
+
+var (
+	errBrokenSegment = errors.New("broken wal segment header")
+	errTornSegment   = errors.New("torn wal segment header") // crash の直前に作られた segment
+)
+
+type segment struct {
+	path     string
+	firstLSN uint64
+}
+
+// segmentedLog is the WAL split into segment files. Records are appended to
+// the last segment, which is rotated when it becomes larger than size.
+type segmentedLog struct {
+	fs         FileSystem
+	prefix     string
+	size       int64
+	archiveDir string    // segments are deleted if empty
+	format     walFormat // of the new segments
+
+	mu          sync.Mutex
+	segments    []segment // sorted by lsn
+	current     File      // last segment, nil until the next write
+	currentSize int64
+	lastLSN     uint64 // lsn of the last record written
+}
+
+func segmentPath(prefix string, firstLSN uint64) string {
+	return fmt.Sprintf("%s.%020d", prefix, firstLSN)
+}
+
+// listSegments returns the segments of the WAL named prefix sorted by lsn.
+func listSegments(fs FileSystem, prefix string) ([]segment, error) {
+	dir, base := filepath.Split(prefix)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		lsn, err := strconv.ParseUint(strings.TrimPrefix(name, base+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: filepath.Join(filepath.Dir(prefix), name), firstLSN: lsn})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstLSN < segments[j].firstLSN
+	})
+	return segments, nil
+}
+
+// segmentLSN returns the first lsn in the name of a segment file.
+func segmentLSN(name string) (uint64, bool) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return 0, false
+	}
+	lsn, err := strconv.ParseUint(name[i+1:], 10, 64)
+	return lsn, err == nil
+}
+
+func openSegmentedLog(fs FileSystem, prefix string, size int64, archiveDir string, format walFormat) (*segmentedLog, error) {
+	if size <= 0 {
+		size = DefaultSegmentSize
+	}
+	segments, err := listSegments(fs, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentedLog{
+		fs:         fs,
+		prefix:     prefix,
+		size:       size,
+		archiveDir: archiveDir,
+		format:     format,
+		segments:   segments,
+	}, nil
+}
+
+// list returns the current segments sorted by lsn.
+func (l *segmentedLog) list() []segment {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]segment(nil), l.segments...)
+}
+
+// write appends buf, whose records have lsns from firstLSN to lastLSN, to the
+// last segment. A new segment is started when the last one is full.
+func (l *segmentedLog) write(buf []byte, firstLSN, lastLSN uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.current != nil && l.currentSize >= l.size {
+		if err := l.current.Sync(); err != nil {
+			return err
+		}
+		if err := l.current.Close(); err != nil {
+			return err
+		}
+		l.current = nil
+	}
+	if l.current == nil {
+		if err := l.create(firstLSN); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.current.Write(buf)
+	l.currentSize += int64(n)
+	if err != nil {
+		return err
+	}
+	l.lastLSN = lastLSN
+	return nil
+}
+
+func (l *segmentedLog) create(firstLSN uint64) error {
+	path := segmentPath(l.prefix, firstLSN)
+	file, err := l.fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	header := newSegmentHeader(l.format)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return err
+	}
+	// segment が作られたことを永続化する
+	if err := l.fs.SyncDir(filepath.Dir(path)); err != nil {
+		file.Close()
+		return err
+	}
+	l.current = file
+	l.currentSize = int64(len(header))
+	l.segments = append(l.segments, segment{path: path, firstLSN: firstLSN})
+	return nil
+}
+
+func (l *segmentedLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current == nil {
+		return nil
+	}
+	return l.current.Sync()
+}
+
+// reset tells the log that every record up to lsn has been written.
+func (l *segmentedLog) reset(lsn uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastLSN = lsn
+}
+
+// removeBefore deletes (or archives) the segments which only contain records
+// up to lsn, e.g. the records covered by a checkpoint.
+func (l *segmentedLog) removeBefore(lsn uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	removed := 0
+	for i, seg := range l.segments {
+		// 次の segment の先頭 lsn (最後の segment なら最後に書いた lsn) までを含む
+		last := l.lastLSN
+		if i+1 < len(l.segments) {
+			last = l.segments[i+1].firstLSN - 1
+		}
+		if last > lsn {
+			break
+		}
+		if i == len(l.segments)-1 && l.current != nil {
+			if err := l.current.Close(); err != nil {
+				return err
+			}
+			l.current = nil
+		}
+		if err := l.archive(seg); err != nil {
+			return err
+		}
+		removed++
+	}
+	l.segments = l.segments[removed:]
+	return nil
+}
+
+// quarantineAfter renames the segments which contain records after lsn to
+// <segment>.corrupted, e.g. the segments after a corrupted record or a missing
+// segment which crash recovery stopped at. Otherwise new records would reuse
+// their lsns, and the next recovery would stop at the same place. complete
+// tells that the segment containing lsn ends at it (it was read to the end).
+// It returns the new names.
+func (l *segmentedLog) quarantineAfter(lsn uint64, complete bool) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	from := len(l.segments)
+	for i, seg := range l.segments {
+		// 最後の lsn は次の segment の先頭の lsn で決める (間の segment が無ければ使えない)
+		if seg.firstLSN > lsn || (!complete && i+1 < len(l.segments) && l.segments[i+1].firstLSN-1 > lsn) {
+			from = i
+			break
+		}
+	}
+	var names []string
+	for _, seg := range l.segments[from:] {
+		if l.current != nil && seg == l.segments[len(l.segments)-1] {
+			if err := l.current.Close(); err != nil {
+				return names, err
+			}
+			l.current = nil
+		}
+		dst := seg.path + quarantineSuffix
+		for i := 1; ; i++ {
+			if _, err := l.fs.Stat(dst); os.IsNotExist(err) {
+				break
+			}
+			dst = fmt.Sprintf("%s%s.%d", seg.path, quarantineSuffix, i)
+		}
+		if err := l.fs.Rename(seg.path, dst); err != nil {
+			return names, err
+		}
+		names = append(names, dst)
+	}
+	l.segments = l.segments[:from]
+	if len(names) == 0 {
+		return nil, nil
+	}
+	return names, l.fs.SyncDir(filepath.Dir(l.prefix))
+}
+
+func (l *segmentedLog) archive(seg segment) error {
+	if l.archiveDir == "" {
+		return l.fs.Remove(seg.path)
+	}
+	if err := l.fs.MkdirAll(l.archiveDir, 0777); err != nil {
+		return err
+	}
+	dst := filepath.Join(l.archiveDir, filepath.Base(seg.path))
+	if err := l.fs.Rename(seg.path, dst); err == nil {
+		return l.fs.SyncDir(l.archiveDir)
+	}
+	// 別の file system なら copy する
+	if err := copyFile(l.fs, seg.path, dst); err != nil {
+		return err
+	}
+	return l.fs.Remove(seg.path)
+}
+
+func (l *segmentedLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current == nil {
+		return nil
+	}
+	err := l.current.Close()
+	l.current = nil
+	return err
+}
+
+func segmentHeader() []byte {
+	return newSegmentHeader(walFormat{})
+}
+
+// newSegmentHeader returns the header of a segment whose records are stored
+// in format.
+func newSegmentHeader(format walFormat) []byte {
+	size, version := segmentHeaderSize, segmentVersion
+	if format.key != nil {
+		size, version = segmentHeaderSize+keyIDSize, segmentEncryptedVersion
+	}
+	header := make([]byte, size)
+	copy(header, segmentMagic)
+	binary.BigEndian.PutUint16(header[4:], uint16(version))
+	binary.BigEndian.PutUint16(header[6:], format.codec.flags())
+	if format.key != nil {
+		binary.BigEndian.PutUint64(header[segmentHeaderSize:], format.key.id)
+	}
+	return header
+}
+
+// openSegment opens a segment and checks its header. The returned file is
+// positioned at the first record, and the format is how its records are
+// stored (the key is looked up in keys).
+func openSegment(fs FileSystem, path string, keys *Keyring) (File, walFormat, error) {
+	var format walFormat
+	file, err := openFile(fs, path)
+	if err != nil {
+		return nil, format, err
+	}
+	header := make([]byte, segmentHeaderSize+keyIDSize)
+	if _, err := io.ReadFull(file, header[:segmentHeaderSize]); err != nil {
+		file.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, format, errTornSegment
+		}
+		return nil, format, err
+	}
+	if string(header[:4]) != segmentMagic {
+		file.Close()
+		return nil, format, errBrokenSegment
+	}
+	flags := binary.BigEndian.Uint16(header[6:])
+	if format.codec, err = compressionOf(flags); err != nil || flags&^codecMask != 0 {
+		file.Close()
+		return nil, format, errBrokenSegment
+	}
+	switch binary.BigEndian.Uint16(header[4:]) {
+	case segmentVersion:
+		return file, format, nil
+	case segmentEncryptedVersion:
+		if _, err := io.ReadFull(file, header[segmentHeaderSize:]); err != nil {
+			file.Close()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, format, errTornSegment
+			}
+			return nil, format, err
+		}
+		if format.key, err = keys.get(binary.BigEndian.Uint64(header[segmentHeaderSize:])); err != nil {
+			file.Close()
+			return nil, format, fmt.Errorf("%v: %w", path, err)
+		}
+		return file, format, nil
+	}
+	file.Close()
+	return nil, format, errBrokenSegment
+}
+
+// checkSegmentKeys returns an error if a segment is encrypted with a key
+// which is not in keys, so that its records are not dropped as corrupted.
+func checkSegmentKeys(fs FileSystem, segments []segment, keys *Keyring) error {
+	for _, seg := range segments {
+		file, _, err := openSegment(fs, seg.path, keys)
+		if isKeyError(err) {
+			return err
+		}
+		if err == nil {
+			file.Close()
+		}
+	}
+	return nil
+}
+
+func copyFile(fs FileSystem, src, dst string) error {
+	in, err := openFile(fs, src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := createFile(fs, dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentedLog_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	walFileName := filepath.Join(dir, "seccampdb.log")
+	archiveDir := filepath.Join(dir, "archive")
+	opts := Options{SegmentSize: 256, ArchiveDir: archiveDir}
+	db := NewDB(walFileName, filepath.Join(dir, "seccampdb.db"), opts)
+
+	for i := 0; i < 20; i++ {
+		tx := NewTx(db)
+		if err := tx.Insert(fmt.Sprintf("key%v", i), fmt.Sprintf("value%v", i)); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+		if _, err := tx.Commit(); err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+		tx.DestructTx()
+	}
+	db.close()
+
+	segments, err := listSegments(osFS{}, walFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("segment is not rotated: %v", segments)
+	}
+	if segments[0].firstLSN != 1 {
+		t.Errorf("wrong first lsn: %v", segments[0].firstLSN)
+	}
+
+	// 全ての segment を順に replay する
+	db = NewDB(walFileName, filepath.Join(dir, "seccampdb.db"), opts)
+	report := db.loadWal()
+	if report.Committed != 20 || report.LastLSN != 60 {
+		t.Fatalf("wrong report: %v", report)
+	}
+	for i := 0; i < 20; i++ {
+		if _, exist := db.index.Load(fmt.Sprintf("key%v", i)); !exist {
+			t.Errorf("key%v is lost", i)
+		}
+	}
+
+	// checkpoint より前の segment は archive される
+	db.wal.resetLSN(report.LastLSN)
+	checkpointLSN := segments[2].firstLSN - 1
+	if err := db.wal.log.removeBefore(checkpointLSN); err != nil {
+		t.Fatal(err)
+	}
+	remained, err := listSegments(osFS{}, walFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived, err := listSegments(osFS{}, filepath.Join(archiveDir, "seccampdb.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 2 || len(remained) != len(segments)-2 || remained[0].firstLSN != segments[2].firstLSN {
+		t.Errorf("wrong segments: remained = %v, archived = %v", remained, archived)
+	}
+
+	if err := db.wal.log.removeBefore(report.LastLSN); err != nil {
+		t.Fatal(err)
+	}
+	if remained, _ := listSegments(osFS{}, walFileName); len(remained) != 0 {
+		t.Errorf("segments are not removed: %v", remained)
+	}
+	db.close()
+}
+
+func TestDB_Setup_CorruptedSegment(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		damage      func(path string) error // 2 つ目の segment を壊す
+		quarantined int                     // 隔離される segment の数 (segment の数から引く)
+	}{
+		{"corrupted", func(path string) error {
+			// 最後の record を壊す
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			buf[len(buf)-1] ^= 0xff
+			return ioutil.WriteFile(path, buf, 0666)
+		}, 1},
+		{"missing", os.Remove, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			walFileName := filepath.Join(dir, "seccampdb.log")
+			dbFileName := filepath.Join(dir, "seccampdb.db")
+			opts := Options{SegmentSize: 128}
+			commit := func(db *DB, key string) {
+				t.Helper()
+				tx := NewTx(db)
+				defer tx.DestructTx()
+				if err := tx.Insert(key, "value"); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tx.Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db := NewDB(walFileName, dbFileName, opts)
+			for i := 0; i < 6; i++ {
+				commit(db, fmt.Sprintf("key%v", i))
+			}
+			db.close()
+			segments, err := listSegments(osFS{}, walFileName)
+			if err != nil || len(segments) < 3 {
+				t.Fatalf("segment is not rotated: %v, %v", segments, err)
+			}
+			if err := tt.damage(segments[1].path); err != nil {
+				t.Fatal(err)
+			}
+
+			db = NewDB(walFileName, dbFileName, opts)
+			if err := db.setup(); err != nil {
+				t.Fatal(err)
+			}
+			// 壊れた所より後の tx は replay しない
+			if _, exist := db.index.Load("key5"); exist {
+				t.Error("tx after the damaged segment is recovered")
+			}
+			if _, exist := db.index.Load("key0"); !exist {
+				t.Error("tx before the damaged segment is lost")
+			}
+			commit(db, "after")
+			db.close()
+
+			// 壊れた所より後の segment は隔離され、その lsn が再利用されても残らない
+			db = NewDB(walFileName, dbFileName, opts)
+			if err := db.setup(); err != nil {
+				t.Fatal(err)
+			}
+			defer db.close()
+			if _, exist := db.index.Load("after"); !exist {
+				t.Error("tx committed after recovery is lost")
+			}
+			quarantined, err := filepath.Glob(walFileName + ".*" + quarantineSuffix)
+			if err != nil || len(quarantined) != len(segments)-tt.quarantined {
+				t.Errorf("wrong quarantined segments: %v, %v", quarantined, err)
+			}
+		})
+	}
+}
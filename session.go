@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// telnet の session
+// tx は begin か (autocommit off なら) 最初の command で始まり、commit か abort で終わる
+// autocommit on では begin していない command をそれぞれ 1 つの tx で実行する
+// connection は commit, abort の後も続き、quit か切断で閉じる (開いている tx は abort する)
+type session struct {
+	db         *DB
+	conn       net.Conn
+	tx         *Tx
+	autocommit bool
+}
+
+// ServeTelnet runs the commands of a telnet session on conn until it is closed.
+func (db *DB) ServeTelnet(conn net.Conn) {
+	s := &session{db: db, conn: conn}
+	defer func() {
+		s.end()
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	for {
+		s.write(s.prompt())
+		if !scanner.Scan() {
+			return
+		}
+		input := strings.Fields(scanner.Text())
+		if len(input) == 0 {
+			continue
+		}
+		if !s.handle(input) {
+			return
+		}
+	}
+}
+
+func (s *session) write(msg string) {
+	s.conn.Write([]byte(msg))
+}
+
+func (s *session) prompt() string {
+	if s.tx != nil {
+		return "seccampdb(tx) >> "
+	}
+	return "seccampdb >> "
+}
+
+// end aborts the open tx.
+func (s *session) end() {
+	if s.tx != nil {
+		s.tx.DestructTx()
+		s.tx = nil
+	}
+}
+
+// handle runs a command and returns false on quit.
+func (s *session) handle(input []string) bool {
+	switch cmd := input[0]; cmd {
+	case "read", "insert", "update", "delete":
+		s.operation(input)
+	case "begin":
+		if len(input) != 1 {
+			s.write("wrong format -> begin\n")
+			break
+		}
+		if s.tx != nil {
+			s.write("a tx is already open\n")
+			break
+		}
+		s.tx = NewTx(s.db)
+	case "commit":
+		if len(input) > 2 {
+			s.write("wrong format -> commit [sync|background|nosync]\n")
+			break
+		}
+		if s.tx == nil {
+			s.write("no tx is open\n")
+			break
+		}
+		if len(input) == 2 {
+			durability, err := ParseDurability(input[1])
+			if err != nil {
+				s.write(err.Error() + "\n")
+				break
+			}
+			s.tx.SetDurability(durability)
+		}
+		s.commit(s.tx)
+		s.end()
+	case "abort":
+		if s.tx == nil {
+			s.write("no tx is open\n")
+			break
+		}
+		s.end()
+		s.write("aborted\n")
+		fmt.Println("aborted")
+	case "autocommit":
+		if len(input) != 2 || (input[1] != "on" && input[1] != "off") {
+			s.write("wrong format -> autocommit on|off\n")
+			break
+		}
+		s.autocommit = input[1] == "on"
+	case "status":
+		s.write(s.status() + "\n")
+	case "quit", "exit":
+		return false
+	case "all":
+		readAll(&s.db.index) // TODO:
+	default:
+		s.write("command not supported\n")
+	}
+	return true
+}
+
+// operation runs read, insert, update or delete in the open tx, or in its own
+// tx in autocommit mode.
+func (s *session) operation(input []string) {
+	cmd := input[0]
+	switch {
+	case (cmd == "read" || cmd == "delete") && len(input) != 2:
+		s.write(fmt.Sprintf("wrong format -> %v <key>\n", cmd))
+		return
+	case (cmd == "insert" || cmd == "update") && len(input) != 3:
+		s.write(fmt.Sprintf("wrong format -> %v <key> <value>\n", cmd))
+		return
+	}
+
+	tx := s.tx
+	if tx == nil && !s.autocommit {
+		s.tx = NewTx(s.db)
+		tx = s.tx
+	}
+	if tx == nil {
+		tx = NewTx(s.db)
+		defer tx.DestructTx()
+		// 1 つだけの op なので、commit で失敗する前に key の有無を確かめられる
+		var err error
+		switch cmd {
+		case "insert":
+			err = checkExists(tx, input[1], false)
+		case "update", "delete":
+			err = checkExists(tx, input[1], true)
+		}
+		if err != nil {
+			s.write(err.Error() + "\n")
+			return
+		}
+	}
+
+	var err error
+	switch cmd {
+	case "read":
+		var value string
+		if value, err = tx.Read(input[1]); err == nil {
+			s.write(value + "\n")
+		}
+	case "insert":
+		err = tx.Insert(input[1], input[2])
+	case "update":
+		err = tx.Update(input[1], input[2])
+	case "delete":
+		err = tx.Delete(input[1])
+	}
+	if err != nil {
+		s.write(err.Error() + "\n")
+		return
+	}
+	if tx != s.tx && cmd != "read" {
+		s.commit(tx)
+	}
+}
+
+func (s *session) commit(tx *Tx) {
+	if _, err := tx.Commit(); err != nil {
+		s.write("aborted: " + err.Error() + "\n")
+		fmt.Println("aborted:", err)
+		return
+	}
+	s.write("committed\n")
+	fmt.Println("committed")
+}
+
+func (s *session) status() string {
+	autocommit := "off"
+	if s.autocommit {
+		autocommit = "on"
+	}
+	if s.tx == nil {
+		return fmt.Sprintf("no tx, autocommit %v", autocommit)
+	}
+	writes := 0
+	for _, ops := range s.tx.writeSet {
+		writes += len(ops)
+	}
+	return fmt.Sprintf("tx %v open (%v reads, %v writes), autocommit %v", s.tx.ts, len(s.tx.readSet), writes, autocommit)
+}
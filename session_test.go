@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// telnetConn sends commands to DB.ServeTelnet.
+type telnetConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	prompt string
+}
+
+func newTelnetConn(t *testing.T, db *DB) *telnetConn {
+	client, server := net.Pipe()
+	go db.ServeTelnet(server)
+	t.Cleanup(func() { client.Close() })
+	c := &telnetConn{t: t, conn: client, reader: bufio.NewReader(client)}
+	c.readUntilPrompt()
+	return c
+}
+
+// readUntilPrompt returns the output before the next prompt.
+func (c *telnetConn) readUntilPrompt() string {
+	c.t.Helper()
+	var out strings.Builder
+	for {
+		s, err := c.reader.ReadString(' ')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		out.WriteString(s)
+		if strings.HasSuffix(out.String(), ">> ") {
+			output := out.String()
+			i := strings.LastIndex(output[:len(output)-len(">> ")], "seccampdb")
+			c.prompt = output[i:]
+			return output[:i]
+		}
+	}
+}
+
+func (c *telnetConn) do(cmd string) string {
+	c.t.Helper()
+	go c.conn.Write([]byte(cmd + "\n"))
+	return c.readUntilPrompt()
+}
+
+func TestServeTelnet(t *testing.T) {
+	db := newTempDB(t, Options{})
+	c := newTelnetConn(t, db)
+
+	for _, tt := range []struct {
+		cmd, want, prompt string
+	}{
+		{"status", "no tx, autocommit off\n", "seccampdb >> "},
+		{"", "", "seccampdb >> "},
+		{"commit", "no tx is open\n", "seccampdb >> "},
+
+		// 最初の command で tx が始まり、commit の後も続けられる
+		{"insert key1 1", "", "seccampdb(tx) >> "},
+		{"read key1", "1\n", "seccampdb(tx) >> "},
+		{"commit nosync", "committed\n", "seccampdb >> "},
+		{"begin", "", "seccampdb(tx) >> "},
+		{"begin", "a tx is already open\n", "seccampdb(tx) >> "},
+		{"update key1 2", "", "seccampdb(tx) >> "},
+		{"read key2", "key doesn't exist\n", "seccampdb(tx) >> "},
+		{"status", "tx 2 open (1 reads, 1 writes), autocommit off\n", "seccampdb(tx) >> "},
+		{"abort", "aborted\n", "seccampdb >> "},
+		{"read key1", "1\n", "seccampdb(tx) >> "},
+		{"abort", "aborted\n", "seccampdb >> "},
+
+		// autocommit
+		{"autocommit on", "", "seccampdb >> "},
+		{"insert key2 2", "committed\n", "seccampdb >> "},
+		{"insert key2 3", "key already exists\n", "seccampdb >> "},
+		{"delete key3", "key doesn't exist\n", "seccampdb >> "},
+		{"read key2", "2\n", "seccampdb >> "},
+		{"status", "no tx, autocommit on\n", "seccampdb >> "},
+		{"begin", "", "seccampdb(tx) >> "},
+		{"delete key2", "", "seccampdb(tx) >> "},
+		{"commit", "committed\n", "seccampdb >> "},
+		{"read key2", "key doesn't exist\n", "seccampdb >> "},
+
+		{"insert key", "wrong format -> insert <key> <value>\n", "seccampdb >> "},
+		{"autocommit", "wrong format -> autocommit on|off\n", "seccampdb >> "},
+		{"scan", "command not supported\n", "seccampdb >> "},
+	} {
+		if got := c.do(tt.cmd); got != tt.want || c.prompt != tt.prompt {
+			t.Errorf("%q: got %q %q, want %q %q", tt.cmd, got, c.prompt, tt.want, tt.prompt)
+		}
+	}
+}
+
+func TestServeTelnet_Quit(t *testing.T) {
+	db := newTempDB(t, Options{})
+	c := newTelnetConn(t, db)
+	c.do("insert key 1")
+	go c.conn.Write([]byte("quit\n"))
+	if _, err := c.reader.ReadByte(); err == nil {
+		t.Fatal("connection should be closed")
+	}
+
+	// quit で開いている tx は abort される
+	c = newTelnetConn(t, db)
+	if got := c.do("read key"); got != "key doesn't exist\n" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// db-file (snapshot)
+// header: | magic "SCDB" (4) | version (2) | flags (2) | lsn (8) | ts (8) | checksum (4) |
+// (version 3 は暗号化された db-file で、checksum の前に key id (8) がある)
+// block:  | 'B' | size (4) | entry count (4) | entry * entry count | checksum (4) |
+// entry:  | key size (4) | value size (4) | wTs (8) | key | value |
+// (version 1 の entry には wTs が無い)
+// footer: | 'F' | block count (4) | entry count (8) | checksum (4) |
+// size は entry 部分の長さ、checksum はそれぞれの先頭からの CRC32C
+// flags の上位 8 bit は block の圧縮の codec で、entry 部分を圧縮してから暗号化する
+// 暗号化された block の entry 部分は block header と block 番号を aad にして seal する
+const (
+	snapshotMagic      = "SCDB"
+	snapshotVersion    = 2
+	encryptedVersion   = 3
+	snapshotHeaderSize = 28
+	keyIDSize          = 8
+	snapshotBlockSize  = 64 << 10
+	blockHeaderSize    = 9
+	footerSize         = 17
+	blockTag           = 'B'
+	footerTag          = 'F'
+)
+
+// header flags
+const (
+	snapshotEncrypted = 1 << iota
+)
+
+var errBrokenSnapshot = errors.New("broken db-file")
+
+type snapshotHeader struct {
+	flags uint16
+	lsn   uint64 // この lsn までに commit された tx を含む
+	ts    uint64 // この ts 以下の tx を含む
+	keyID uint64 // 暗号化されていれば鍵の id
+	codec Compression
+}
+
+type snapshotEntry struct {
+	key   string
+	value string
+	wTs   uint64 // commit ts of the version
+}
+
+// snapshotWriter writes entries into checksummed blocks, encrypted if key is
+// not nil.
+type snapshotWriter struct {
+	w       *bufio.Writer
+	key     *cipherKey
+	codec   Compression
+	block   []byte // entries of the current block
+	count   uint32 // entries in the current block
+	blocks  uint32
+	entries uint64
+}
+
+func newSnapshotWriter(w io.Writer, header *snapshotHeader, key *cipherKey) (*snapshotWriter, error) {
+	version := uint16(snapshotVersion)
+	flags := header.flags | header.codec.flags()
+	size := snapshotHeaderSize
+	if key != nil {
+		version = encryptedVersion
+		flags |= snapshotEncrypted
+		size += keyIDSize
+	}
+	buf := make([]byte, size)
+	copy(buf, snapshotMagic)
+	binary.BigEndian.PutUint16(buf[4:], version)
+	binary.BigEndian.PutUint16(buf[6:], flags)
+	binary.BigEndian.PutUint64(buf[8:], header.lsn)
+	binary.BigEndian.PutUint64(buf[16:], header.ts)
+	if key != nil {
+		binary.BigEndian.PutUint64(buf[24:], key.id)
+	}
+	binary.BigEndian.PutUint32(buf[size-4:], crc32.Checksum(buf[:size-4], crc32c))
+
+	sw := &snapshotWriter{w: bufio.NewWriter(w), key: key, codec: header.codec}
+	if _, err := sw.w.Write(buf); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *snapshotWriter) add(key, value string, wTs uint64) error {
+	var header [16]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(len(key)))
+	binary.BigEndian.PutUint32(header[4:], uint32(len(value)))
+	binary.BigEndian.PutUint64(header[8:], wTs)
+	sw.block = append(sw.block, header[:]...)
+	sw.block = append(sw.block, key...)
+	sw.block = append(sw.block, value...)
+	sw.count++
+	sw.entries++
+	if len(sw.block) >= snapshotBlockSize {
+		return sw.flushBlock()
+	}
+	return nil
+}
+
+func (sw *snapshotWriter) flushBlock() error {
+	if sw.count == 0 {
+		return nil
+	}
+	payload := sw.codec.compress(sw.block)
+	size := len(payload)
+	if sw.key != nil {
+		size += sealedSize
+	}
+	header := make([]byte, blockHeaderSize)
+	header[0] = blockTag
+	binary.BigEndian.PutUint32(header[1:], uint32(size))
+	binary.BigEndian.PutUint32(header[5:], sw.count)
+	if sw.key != nil {
+		payload = sw.key.seal(payload, blockAAD(header, sw.blocks))
+	}
+	checksum := crc32.Update(crc32.Checksum(header, crc32c), crc32c, payload)
+	var trailer [4]byte
+	binary.BigEndian.PutUint32(trailer[:], checksum)
+
+	for _, b := range [][]byte{header, payload, trailer[:]} {
+		if _, err := sw.w.Write(b); err != nil {
+			return err
+		}
+	}
+	sw.block = sw.block[:0]
+	sw.count = 0
+	sw.blocks++
+	return nil
+}
+
+// close writes the last block and the footer.
+func (sw *snapshotWriter) close() error {
+	if err := sw.flushBlock(); err != nil {
+		return err
+	}
+	buf := make([]byte, footerSize)
+	buf[0] = footerTag
+	binary.BigEndian.PutUint32(buf[1:], sw.blocks)
+	binary.BigEndian.PutUint64(buf[5:], sw.entries)
+	binary.BigEndian.PutUint32(buf[13:], crc32.Checksum(buf[:13], crc32c))
+	if _, err := sw.w.Write(buf); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+// blockAAD binds an encrypted block to its header and position.
+func blockAAD(header []byte, index uint32) []byte {
+	aad := make([]byte, len(header)+4)
+	copy(aad, header)
+	binary.BigEndian.PutUint32(aad[len(header):], index)
+	return aad
+}
+
+// snapshotReader reads the blocks of a db-file and verifies them.
+type snapshotReader struct {
+	r       *bufio.Reader
+	version uint16
+	key     *cipherKey // nil if not encrypted
+	header  *snapshotHeader
+	blocks  uint32 // blocks read so far
+	entries uint64 // entries read so far
+}
+
+// newSnapshotReader reads the header of a db-file. It returns io.EOF if the
+// db-file is empty. An encrypted db-file is decrypted with the key of keys.
+func newSnapshotReader(r io.Reader, keys *Keyring) (*snapshotReader, error) {
+	reader := bufio.NewReader(r)
+	buf := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: header is truncated", errBrokenSnapshot)
+		}
+		return nil, err
+	}
+	if string(buf[:4]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: not a seccampdb db-file", errBrokenSnapshot)
+	}
+	version := binary.BigEndian.Uint16(buf[4:])
+	if version == encryptedVersion {
+		buf = append(buf, make([]byte, keyIDSize)...)
+		if _, err := io.ReadFull(reader, buf[snapshotHeaderSize:]); err != nil {
+			return nil, fmt.Errorf("%w: header is truncated", errBrokenSnapshot)
+		}
+	}
+	size := len(buf)
+	if binary.BigEndian.Uint32(buf[size-4:]) != crc32.Checksum(buf[:size-4], crc32c) {
+		return nil, fmt.Errorf("%w: header checksum mismatch", errBrokenSnapshot)
+	}
+	if version < 1 || version > encryptedVersion {
+		return nil, fmt.Errorf("%w: unsupported version %v", errBrokenSnapshot, version)
+	}
+	sr := &snapshotReader{
+		r:       reader,
+		version: version,
+		header: &snapshotHeader{
+			flags: binary.BigEndian.Uint16(buf[6:]),
+			lsn:   binary.BigEndian.Uint64(buf[8:]),
+			ts:    binary.BigEndian.Uint64(buf[16:]),
+		},
+	}
+	codec, err := compressionOf(sr.header.flags)
+	if err != nil || sr.header.flags&^(snapshotEncrypted|codecMask) != 0 {
+		return nil, fmt.Errorf("%w: unsupported flags %v", errBrokenSnapshot, sr.header.flags)
+	}
+	sr.header.codec = codec
+	if sr.header.flags&snapshotEncrypted != 0 {
+		if version != encryptedVersion {
+			return nil, fmt.Errorf("%w: unsupported flags %v", errBrokenSnapshot, sr.header.flags)
+		}
+		sr.header.keyID = binary.BigEndian.Uint64(buf[24:])
+		key, err := keys.get(sr.header.keyID)
+		if err != nil {
+			return nil, err
+		}
+		sr.key = key
+	}
+	return sr, nil
+}
+
+// next returns the entries of the next block. It returns io.EOF after a valid
+// footer. A block whose checksum does not match is skipped and reported as
+// errChecksum, any other error means the rest of the db-file is unreadable.
+func (sr *snapshotReader) next() ([]snapshotEntry, error) {
+	tag, err := sr.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: footer is missing", errBrokenSnapshot)
+	}
+	switch tag {
+	case footerTag:
+		return nil, sr.readFooter()
+	case blockTag:
+	default:
+		return nil, fmt.Errorf("%w: unknown block (block %v)", errBrokenSnapshot, sr.blocks)
+	}
+
+	header := make([]byte, blockHeaderSize)
+	header[0] = tag
+	if _, err := io.ReadFull(sr.r, header[1:]); err != nil {
+		return nil, fmt.Errorf("%w: block %v is truncated", errBrokenSnapshot, sr.blocks)
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	count := binary.BigEndian.Uint32(header[5:])
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("%w: block %v is too large", errBrokenSnapshot, sr.blocks)
+	}
+	buf := make([]byte, size+4)
+	if _, err := io.ReadFull(sr.r, buf); err != nil {
+		return nil, fmt.Errorf("%w: block %v is truncated", errBrokenSnapshot, sr.blocks)
+	}
+	sr.blocks++
+	payload := buf[:size]
+	checksum := crc32.Update(crc32.Checksum(header, crc32c), crc32c, payload)
+	if binary.BigEndian.Uint32(buf[size:]) != checksum {
+		return nil, errChecksum
+	}
+	if sr.key != nil {
+		if payload, err = sr.key.open(payload, blockAAD(header, sr.blocks-1)); err != nil {
+			return nil, err
+		}
+	}
+	if payload, err = sr.header.codec.decompress(payload); err != nil {
+		return nil, errChecksum
+	}
+
+	entryHeaderSize := 16
+	if sr.version == 1 {
+		entryHeaderSize = 8
+	}
+	entries := make([]snapshotEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < entryHeaderSize {
+			return nil, errChecksum
+		}
+		keySize := binary.BigEndian.Uint32(payload[0:])
+		valueSize := binary.BigEndian.Uint32(payload[4:])
+		var wTs uint64
+		if sr.version > 1 {
+			wTs = binary.BigEndian.Uint64(payload[8:])
+		}
+		payload = payload[entryHeaderSize:]
+		if uint64(keySize)+uint64(valueSize) > uint64(len(payload)) {
+			return nil, errChecksum
+		}
+		entries = append(entries, snapshotEntry{
+			key:   string(payload[:keySize]),
+			value: string(payload[keySize : keySize+valueSize]),
+			wTs:   wTs,
+		})
+		payload = payload[keySize+valueSize:]
+	}
+	sr.entries += uint64(count)
+	return entries, nil
+}
+
+func (sr *snapshotReader) readFooter() error {
+	buf := make([]byte, footerSize)
+	buf[0] = footerTag
+	if _, err := io.ReadFull(sr.r, buf[1:]); err != nil {
+		return fmt.Errorf("%w: footer is truncated", errBrokenSnapshot)
+	}
+	if binary.BigEndian.Uint32(buf[13:]) != crc32.Checksum(buf[:13], crc32c) {
+		return fmt.Errorf("%w: footer checksum mismatch", errBrokenSnapshot)
+	}
+	blocks := binary.BigEndian.Uint32(buf[1:])
+	entries := binary.BigEndian.Uint64(buf[5:])
+	if blocks != sr.blocks || entries != sr.entries {
+		return fmt.Errorf("%w: %v blocks and %v entries are expected, but %v blocks and %v entries are read",
+			errBrokenSnapshot, blocks, entries, sr.blocks, sr.entries)
+	}
+	if _, err := sr.r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("%w: garbage after the footer", errBrokenSnapshot)
+	}
+	return io.EOF
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestSnapshot(t *testing.T, n int) []byte {
+	buf := new(bytes.Buffer)
+	writer, err := newSnapshotWriter(buf, &snapshotHeader{lsn: 10, ts: 5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		// 空白や改行、大きな値も保存できる
+		value := fmt.Sprintf("value %v\n%v", i, strings.Repeat("v", i*100))
+		if err := writer.add(fmt.Sprintf("key %v", i), value, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshot(t *testing.T) {
+	n := 300
+	reader, err := newSnapshotReader(bytes.NewReader(writeTestSnapshot(t, n)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.header.lsn != 10 || reader.header.ts != 5 {
+		t.Errorf("wrong header: %v", reader.header)
+	}
+	i := 0
+	for {
+		entries, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.key != fmt.Sprintf("key %v", i) || !strings.HasPrefix(entry.value, fmt.Sprintf("value %v\n", i)) || entry.wTs != uint64(i) {
+				t.Errorf("wrong entry: %v", entry.key)
+			}
+			i++
+		}
+	}
+	if i != n || reader.blocks < 2 {
+		t.Errorf("wrong number of entries: %v entries in %v blocks", i, reader.blocks)
+	}
+}
+
+func TestDB_LoadData_Broken(t *testing.T) {
+	buf := writeTestSnapshot(t, 300)
+	dir := t.TempDir()
+	dbFileName := filepath.Join(dir, "seccampdb.db")
+
+	tests := []struct {
+		name    string
+		data    []byte
+		partial bool // ForceRecovery で壊れた block 以外は読める
+	}{
+		{"header", append([]byte("XXXX"), buf[4:]...), false},
+		{"block", append(append(append([]byte{}, buf[:100]...), buf[100]^0xff), buf[101:]...), true},
+		{"footer is missing", buf[:len(buf)-footerSize], false},
+		{"truncated", buf[:len(buf)/2], true},
+		{"broken data", []byte("test1 value1\nbroken\n"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(dbFileName, tt.data, 0666); err != nil {
+				t.Fatal(err)
+			}
+			db := NewDB(filepath.Join(dir, "seccampdb.log"), dbFileName, Options{})
+			defer db.close()
+			if err := db.loadData(); !errors.Is(err, errBrokenSnapshot) {
+				t.Errorf("should be failed: %v", err)
+			}
+
+			forced := NewDB(filepath.Join(dir, "seccampdb.log"), dbFileName, Options{ForceRecovery: true})
+			defer forced.close()
+			if err := forced.loadData(); err != nil {
+				t.Errorf("failed to force recovery: %v", err)
+			}
+			loaded := 0
+			forced.index.Range(func(k, v interface{}) bool {
+				loaded++
+				return true
+			})
+			if tt.partial && (loaded == 0 || loaded == 300) {
+				t.Errorf("wrong number of entries: %v", loaded)
+			}
+		})
+	}
+}
@@ -3,8 +3,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"hash/crc32"
-	"log"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -19,6 +17,12 @@ const (
 	NotExist
 )
 
+var (
+	errKeyNotExist  = errors.New("key doesn't exist")
+	errKeyExists    = errors.New("key already exists")
+	errCommitFailed = errors.New("failed to commit") // 他の tx と衝突した
+)
+
 type Record struct {
 	key  string
 	last *Version
@@ -43,24 +47,31 @@ type WriteSet map[string][]*Operation
 type ReadSet map[string]*Version
 
 type Tx struct {
-	ts       uint64
-	writeSet WriteSet
-	readSet  ReadSet
-	db       *DB
+	ts         uint64
+	writeSet   WriteSet
+	readSet    ReadSet
+	db         *DB
+	durability Durability
 }
 
 func NewTx(db *DB) *Tx {
+	// ts を決めてから aliveTx に入るまでの間に checkpoint が始まらないようにする
+	db.aliveTx.mu.Lock()
+	defer db.aliveTx.mu.Unlock()
 	ts := atomic.AddUint64(&db.tsGenerator, 1)
-	tx := &Tx{
-		ts:       ts,
-		writeSet: make(WriteSet),
-		readSet:  make(ReadSet),
-		db:       db,
-	}
-	tx.db.aliveTx.mu.Lock()
-	defer tx.db.aliveTx.mu.Unlock()
 	db.aliveTx.txs = append(db.aliveTx.txs, ts)
-	return tx
+	return &Tx{
+		ts:         ts,
+		writeSet:   make(WriteSet),
+		readSet:    make(ReadSet),
+		db:         db,
+		durability: db.opts.Durability,
+	}
+}
+
+// SetDurability overrides the durability of the DB for this tx.
+func (tx *Tx) SetDurability(durability Durability) {
+	tx.durability = durability
 }
 
 func (tx *Tx) DestructTx() {
@@ -102,7 +113,7 @@ func (tx *Tx) Read(key string) (string, error) {
 	// data does not exist
 	if !exist {
 		tx.readSet[key] = version
-		return "", errors.New("key doesn't exist")
+		return "", errKeyNotExist
 	}
 
 	// data in index
@@ -112,7 +123,7 @@ func (tx *Tx) Read(key string) (string, error) {
 	cur := record.last
 	for cur.wTs > tx.ts {
 		if cur.deleted { // delete flag check
-			return "", errors.New("key doesn't exist")
+			return "", errKeyNotExist
 		}
 		cur = cur.prev
 		if cur == nil {
@@ -120,10 +131,10 @@ func (tx *Tx) Read(key string) (string, error) {
 		}
 	}
 	if cur == nil { // cannot traverse
-		return "", errors.New("key doesn't exist")
+		return "", errKeyNotExist
 	}
 	if cur.deleted { // delete flag check
-		return "", errors.New("key doesn't exist")
+		return "", errKeyNotExist
 	}
 	cur.rTs = tx.ts
 	tx.readSet[key] = cur
@@ -131,6 +142,9 @@ func (tx *Tx) Read(key string) (string, error) {
 }
 
 func (tx *Tx) Insert(key, value string) error {
+	if err := tx.db.Degraded(); err != nil {
+		return err
+	}
 	_, where := tx.checkExistence(key) // read/write-set の確認だけにする、ここでdeletedの確認をしたところで、commit時には変わっているかもしれない
 	if where == NotInRWSet || where == Deleted {
 		v := Version{
@@ -144,13 +158,16 @@ func (tx *Tx) Insert(key, value string) error {
 		tx.writeSet[key] = append(tx.writeSet[key], &Operation{cmd: INSERT, version: &v})
 		return nil
 	}
-	return errors.New("key already exists")
+	return errKeyExists
 }
 
 func (tx *Tx) Update(key, value string) error {
+	if err := tx.db.Degraded(); err != nil {
+		return err
+	}
 	_, where := tx.checkExistence(key) // read/write-set の確認だけにする
 	if where == Deleted {
-		return errors.New("key doesn't exist")
+		return errKeyNotExist
 	}
 	v := Version{
 		key:     key,
@@ -165,9 +182,12 @@ func (tx *Tx) Update(key, value string) error {
 }
 
 func (tx *Tx) Delete(key string) error {
+	if err := tx.db.Degraded(); err != nil {
+		return err
+	}
 	_, where := tx.checkExistence(key) // read/write-set の確認だけにする
 	if where == Deleted {
-		return errors.New("key doesn't exist")
+		return errKeyNotExist
 	}
 	v := Version{
 		key:     key,
@@ -181,8 +201,24 @@ func (tx *Tx) Delete(key string) error {
 	return nil
 }
 
-func (tx *Tx) Commit() error {
+// Commit returns the lsn of the commit record of tx, or 0 if tx has no writes
+// (nothing is written to the wal). If the wal cannot be written, the
+// write-set is not applied and the DB becomes read-only.
+func (tx *Tx) Commit() (uint64, error) {
 	var err error
+	var lsn uint64
+
+	// 読み取りだけの tx は wal に書かない (read-only でも commit できる)
+	if len(tx.writeSet) == 0 {
+		return 0, nil
+	}
+	if err := tx.db.Degraded(); err != nil {
+		return 0, err
+	}
+	if err := tx.db.startCommit(tx.ts); err != nil {
+		return 0, err
+	}
+	defer tx.db.endCommit(tx.ts)
 
 	var sortedWriteSet []*Operation
 	for _, ops := range tx.writeSet {
@@ -206,7 +242,11 @@ func (tx *Tx) Commit() error {
 				record.mu.Lock()
 				lockedRecord[op.version.key] = record
 				if !record.last.deleted {
-					err = errors.New("failed to commit INSERT")
+					err = fmt.Errorf("%w INSERT", errCommitFailed)
+					goto unlock
+				}
+				if tx.ts < record.last.rTs { // 後の tx が無いことを読んでいる
+					err = fmt.Errorf("%w INSERT", errCommitFailed)
 					goto unlock
 				}
 				continue
@@ -221,7 +261,7 @@ func (tx *Tx) Commit() error {
 			lockedRecord[op.version.key] = record
 			_, exist = tx.db.index.LoadOrStore(op.version.key, record)
 			if exist {
-				err = errors.New("failed to commit INSERT")
+				err = fmt.Errorf("%w INSERT", errCommitFailed)
 				goto unlock
 			}
 		case UPDATE:
@@ -232,18 +272,18 @@ func (tx *Tx) Commit() error {
 
 			v, exist := tx.db.index.Load(op.version.key)
 			if !exist {
-				err = errors.New("failed to commit UPDATE")
+				err = fmt.Errorf("%w UPDATE", errCommitFailed)
 				goto unlock
 			}
 			record := v.(*Record)
 			record.mu.Lock()
 			lockedRecord[op.version.key] = record
 			if record.last.deleted {
-				err = errors.New("failed to commit UPDATE")
+				err = fmt.Errorf("%w UPDATE", errCommitFailed)
 				goto unlock
 			}
 			if tx.ts < record.last.rTs {
-				err = errors.New("failed to commit UPDATE")
+				err = fmt.Errorf("%w UPDATE", errCommitFailed)
 				goto unlock
 			}
 		case DELETE:
@@ -253,26 +293,28 @@ func (tx *Tx) Commit() error {
 			}
 			v, exist := tx.db.index.Load(op.version.key)
 			if !exist {
-				err = errors.New("failed to commit DELETE")
+				err = fmt.Errorf("%w DELETE", errCommitFailed)
 				goto unlock
 			}
 			record := v.(*Record)
 			record.mu.Lock()
 			lockedRecord[op.version.key] = record
 			if record.last.deleted {
-				err = errors.New("failed to commit DELETE")
+				err = fmt.Errorf("%w DELETE", errCommitFailed)
 				goto unlock
 			}
 			if tx.ts < record.last.rTs {
-				err = errors.New("failed to commit DELETE")
+				err = fmt.Errorf("%w DELETE", errCommitFailed)
 				goto unlock
 			}
 		}
 	}
 
 	// write-set -> wal
-	if err := tx.SaveWal(); err != nil {
-		log.Println(err)
+	if lsn, err = tx.SaveWal(); err != nil {
+		// wal に書けなかった write-set は db-memory に反映しない
+		lsn = 0
+		goto unlock
 	}
 
 	// write-set -> db-memory
@@ -280,6 +322,10 @@ func (tx *Tx) Commit() error {
 		switch op.cmd {
 		case INSERT:
 			record := lockedRecord[op.version.key]
+			if record.last != op.version { // 消された record に insert する
+				op.version.prev = record.last
+				record.last = op.version
+			}
 			record.last.deleted = false
 		case UPDATE:
 			record := lockedRecord[op.version.key]
@@ -300,7 +346,7 @@ unlock:
 		record.mu.Unlock()
 	}
 
-	return err
+	return lsn, err
 }
 
 func (tx *Tx) Abort() {
@@ -332,31 +378,35 @@ func (tx *Tx) checkExistence(key string) (*Version, uint) {
 	return nil, NotInRWSet
 }
 
-func (tx *Tx) SaveWal() error {
-	// make redo log
-	buf := make([]byte, 4096)
-	idx := uint(0) // 書き込み開始位置
+// SaveWal writes the write-set to the wal and returns the lsn of its commit
+// record. It is durable when SaveWal returns if the durability is SyncOnCommit.
+func (tx *Tx) SaveWal() (uint64, error) {
+	opCount := 0
+	for _, operations := range tx.writeSet {
+		opCount += len(operations)
+	}
 
+	// make redo log (lsn は書き込む順に決まる)
+	recs := []*walRecord{{typ: recBegin, ts: tx.ts, opCount: uint32(opCount)}}
 	for _, operations := range tx.writeSet {
 		for _, op := range operations {
-			checksum := crc32.ChecksumIEEE([]byte(op.version.key))
-
-			// serialize data
-			size := serialize(buf, idx, op, checksum)
-			idx += size
+			recs = append(recs, &walRecord{typ: recOperation, op: op})
 		}
 	}
-
-	tx.db.walMu.Lock()
-	if _, err := tx.db.wALFile.Write(buf); err != nil {
-		return err
-	}
-	if err := tx.db.wALFile.Sync(); err != nil {
-		return err
+	recs = append(recs, &walRecord{typ: recCommit, ts: tx.ts})
+	format := tx.db.wal.log.format
+	records := make([][]byte, 0, len(recs))
+	for _, rec := range recs {
+		buf, err := encodeRecord(rec)
+		if err != nil {
+			return 0, err
+		}
+		// 暗号化は lsn が決まってから (groupCommitter.commit)
+		records = append(records, format.codec.compressRecord(buf))
 	}
-	tx.db.walMu.Unlock()
 
-	return nil
+	// 他の tx とまとめて書き込まれ、(SyncOnCommit なら) 永続化されるまで待つ
+	return tx.db.wal.commit(records, tx.durability)
 }
 
 // read all data in db-memory
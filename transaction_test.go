@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -8,7 +9,7 @@ import (
 
 // 1 tx
 func TestPattern1(t *testing.T) {
-	db := NewTestDB()
+	db := newTempDB(t, Options{})
 	tx := NewTx(db)
 	if err := tx.Insert("key1", "value1"); err != nil {
 		t.Fatalf("failed to insert: %v\n", err)
@@ -28,7 +29,7 @@ func TestPattern1(t *testing.T) {
 	if err := tx.Delete("key2"); err != nil {
 		t.Fatalf("failed to delete: %v\n", err)
 	}
-	if err := tx.Commit(); err != nil {
+	if _, err := tx.Commit(); err != nil {
 		t.Fatalf("failed to commit: %v", err)
 	}
 	tx.DestructTx()
@@ -44,7 +45,7 @@ func TestPattern1(t *testing.T) {
 
 // 2 tx concurrent
 func TestPattern2(t *testing.T) {
-	db := NewTestDB()
+	db := newTempDB(t, Options{})
 
 	v1 := &Version{
 		key:     "key1",
@@ -98,10 +99,10 @@ func TestPattern2(t *testing.T) {
 		t.Errorf("failed to delete: %v", err)
 	}
 
-	if err := tx2.Commit(); err != nil {
+	if _, err := tx2.Commit(); err != nil {
 		t.Fatalf("failed to commit: %v", err)
 	}
-	if err := tx1.Commit(); err == nil {
+	if _, err := tx1.Commit(); err == nil {
 		t.Fatal("should be failed")
 	}
 	tx1.DestructTx()
@@ -113,7 +114,7 @@ func TestPattern2(t *testing.T) {
 	if err := tx1.Delete("key1"); err != nil {
 		t.Errorf("failed to delete: %v", err)
 	}
-	if err := tx1.Commit(); err != nil {
+	if _, err := tx1.Commit(); err != nil {
 		t.Fatalf("failed to commit: %v", err)
 	}
 
@@ -142,7 +143,7 @@ func TestPattern2(t *testing.T) {
 
 // 2 tx parallel
 func TestPattern3(t *testing.T) {
-	db := NewTestDB()
+	db := newTempDB(t, Options{})
 
 	v1 := &Version{
 		key:     "key1",
@@ -200,7 +201,7 @@ func TestPattern3(t *testing.T) {
 			t.Fatalf("failed to insert: %v", err)
 		}
 		time.Sleep(time.Second * 3)
-		if err := tx1.Commit(); err != nil {
+		if _, err := tx1.Commit(); err != nil {
 			t.Fatalf("failed to commit: %v", err)
 		}
 		tx1.DestructTx()
@@ -221,7 +222,7 @@ func TestPattern3(t *testing.T) {
 			t.Fatalf("failed to delete: %v", err)
 		}
 		time.Sleep(time.Second * 3)
-		if err := tx2.Commit(); err != nil {
+		if _, err := tx2.Commit(); err != nil {
 			t.Fatalf("failed to commit: %v", err)
 		}
 		tx2.DestructTx()
@@ -261,7 +262,7 @@ func TestPattern3(t *testing.T) {
 			t.Fatalf("failed to insert: %v", err)
 		}
 		time.Sleep(time.Second * 3)
-		if err := tx1.Commit(); err != nil {
+		if _, err := tx1.Commit(); err != nil {
 			t.Fatalf("failed to commit: %v", err)
 		}
 		tx1.DestructTx()
@@ -315,7 +316,7 @@ func TestPattern3(t *testing.T) {
 }
 
 func TestLogicalDelete(t *testing.T) {
-	db := NewTestDB()
+	db := newTempDB(t, Options{})
 	v1 := &Version{
 		key:     "key1",
 		value:   "value1",
@@ -338,7 +339,7 @@ func TestLogicalDelete(t *testing.T) {
 	if err := tx2.Delete("key1"); err != nil {
 		t.Fatalf("failed to delete: %v\n", err)
 	}
-	if err := tx1.Commit(); err != nil {
+	if _, err := tx1.Commit(); err != nil {
 		t.Fatalf("failed to commit: %v", err)
 	}
 	tx1.DestructTx()
@@ -353,13 +354,13 @@ func TestLogicalDelete(t *testing.T) {
 	if err := tx2.Insert("key1", "value1"); err != nil {
 		t.Fatalf("failed to insert: %v\n", err)
 	}
-	if err := tx2.Commit(); err == nil {
+	if _, err := tx2.Commit(); err == nil {
 		t.Fatal("should be failed")
 	}
 }
 
 func TestTx_Read(t *testing.T) {
-	db := NewTestDB()
+	db := newTempDB(t, Options{})
 	tx := NewTx(db)
 
 	// record in read-set
@@ -414,7 +415,7 @@ func TestTx_Read(t *testing.T) {
 }
 
 func TestTx_Insert(t *testing.T) {
-	db := NewTestDB()
+	db := newTempDB(t, Options{})
 	tx := NewTx(db)
 
 	if err := tx.Insert("test_insert", "ans"); err != nil {
@@ -432,7 +433,7 @@ func TestTx_Insert(t *testing.T) {
 }
 
 func TestTx_Update(t *testing.T) {
-	db := NewTestDB()
+	db := newTempDB(t, Options{})
 	tx := NewTx(db)
 	tx.writeSet["test_update"] = append(tx.writeSet["test_update"], &Operation{
 		cmd: INSERT,
@@ -455,7 +456,7 @@ func TestTx_Update(t *testing.T) {
 }
 
 func TestTx_Delete(t *testing.T) {
-	db := NewTestDB()
+	db := newTempDB(t, Options{})
 	tx := NewTx(db)
 	tx.writeSet["test_delete"] = append(tx.writeSet["test_delete"], &Operation{
 		cmd: INSERT,
@@ -478,7 +479,7 @@ func TestTx_Delete(t *testing.T) {
 }
 
 func TestTx_Commit(t *testing.T) {
-	db := NewTestDB()
+	db := newTempDB(t, Options{})
 	v1 := &Version{
 		key:     "test_commit1",
 		value:   "ans1",
@@ -530,7 +531,7 @@ func TestTx_Commit(t *testing.T) {
 		},
 	})
 
-	if err := tx.Commit(); err != nil {
+	if _, err := tx.Commit(); err != nil {
 		t.Fatalf("failed to commit: %v", err)
 	}
 
@@ -548,3 +549,56 @@ func TestTx_Commit(t *testing.T) {
 	}
 	tx.DestructTx()
 }
+
+func TestTx_Commit_WalError(t *testing.T) {
+	db := newTempDB(t, Options{})
+
+	tx := NewTx(db)
+	tx.Insert("key1", "value1")
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.DestructTx()
+
+	// 読み取りだけの tx は wal に書かない
+	next := db.wal.next()
+	tx = NewTx(db)
+	tx.Read("key1")
+	if lsn, err := tx.Commit(); err != nil || lsn != 0 || db.wal.next() != next {
+		t.Errorf("read-only tx should not write wal: lsn = %v, %v", lsn, err)
+	}
+	tx.DestructTx()
+
+	// wal に書けなくする
+	db.wal.log.current.Close()
+
+	tx = NewTx(db)
+	tx.Update("key1", "value11")
+	tx.Insert("key2", "value2")
+	if _, err := tx.Commit(); !errors.Is(err, errReadOnly) {
+		t.Errorf("commit should fail: %v", err)
+	}
+	tx.DestructTx()
+	if v, _ := db.index.Load("key1"); v.(*Record).last.value != "value1" {
+		t.Errorf("failed commit should not be applied: %v", v.(*Record).last.value)
+	}
+	if v, exist := db.index.Load("key2"); exist && !v.(*Record).last.deleted {
+		t.Error("failed commit should not be applied")
+	}
+
+	// 以後は read-only
+	if !errors.Is(db.Degraded(), errReadOnly) {
+		t.Errorf("db should be read-only: %v", db.Degraded())
+	}
+	tx = NewTx(db)
+	defer tx.DestructTx()
+	if err := tx.Insert("key3", "value3"); !errors.Is(err, errReadOnly) {
+		t.Errorf("write should fail: %v", err)
+	}
+	if value, err := tx.Read("key1"); err != nil || value != "value1" {
+		t.Errorf("read should succeed: %v, %v", value, err)
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Errorf("read-only tx should commit: %v", err)
+	}
+}
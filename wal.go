@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// WAL record
+// | size (4) | lsn (8) | type (1) | body | checksum (4) |
+// size は checksum を含む record 全体の長さ
+// lsn は record 毎に 1 ずつ増える通し番号
+// checksum は size から body の終わりまでの CRC32C
+// type の最上位 bit は body が圧縮されていることを示す (compression.go)
+//
+// 1 tx は begin, operation * op count, commit の順に書かれる
+// begin:     body = | ts (8) | op count (4) |
+// operation: body = | cmd (1) | key size (4) | key | value |
+// commit:    body = | ts (8) |
+const (
+	WALPageSize      = 4096
+	recordHeaderSize = 13
+	checksumSize     = 4
+	maxRecordSize    = 1 << 30
+)
+
+// WAL record type
+const (
+	recBegin = 1 + iota
+	recOperation
+	recCommit
+)
+
+var (
+	errBrokenRecord = errors.New("broken wal record")
+	errChecksum     = errors.New("wal checksum mismatch")
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type walRecord struct {
+	lsn     uint64
+	typ     uint8
+	ts      uint64     // begin, commit
+	opCount uint32     // begin
+	op      *Operation // operation
+}
+
+// serialize writes rec as one WAL record. The record may be larger than a page,
+// the caller's writer is responsible for splitting it into pages.
+func serialize(w io.Writer, rec *walRecord) error {
+	buf, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func encodeRecord(rec *walRecord) ([]byte, error) {
+	var bodySize int
+	switch rec.typ {
+	case recBegin:
+		bodySize = 12
+	case recOperation:
+		bodySize = 5 + len(rec.op.version.key) + len(rec.op.version.value)
+	case recCommit:
+		bodySize = 8
+	default:
+		return nil, errors.New("unknown wal record type")
+	}
+	size := recordHeaderSize + bodySize + checksumSize
+	if size > maxRecordSize {
+		return nil, errors.New("record too large")
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:], uint32(size))
+	binary.BigEndian.PutUint64(buf[4:], rec.lsn)
+	buf[12] = rec.typ
+	body := buf[recordHeaderSize : size-checksumSize]
+	switch rec.typ {
+	case recBegin:
+		binary.BigEndian.PutUint64(body[0:], rec.ts)
+		binary.BigEndian.PutUint32(body[8:], rec.opCount)
+	case recOperation:
+		key := rec.op.version.key
+		body[0] = rec.op.cmd
+		binary.BigEndian.PutUint32(body[1:], uint32(len(key)))
+		copy(body[5:], key)
+		copy(body[5+len(key):], rec.op.version.value)
+	case recCommit:
+		binary.BigEndian.PutUint64(body[0:], rec.ts)
+	}
+	binary.BigEndian.PutUint32(buf[size-checksumSize:], crc32.Checksum(buf[:size-checksumSize], crc32c))
+
+	return buf, nil
+}
+
+// withBody returns a copy of an encoded record whose type and body are
+// replaced.
+func withBody(buf []byte, typ uint8, body []byte) []byte {
+	size := recordHeaderSize + len(body) + checksumSize
+	rec := make([]byte, size)
+	binary.BigEndian.PutUint32(rec[0:], uint32(size))
+	copy(rec[4:12], buf[4:12])
+	rec[12] = typ
+	copy(rec[recordHeaderSize:], body)
+	binary.BigEndian.PutUint32(rec[size-checksumSize:], crc32.Checksum(rec[:size-checksumSize], crc32c))
+	return rec
+}
+
+// setLSN overwrites the lsn of an encoded record and updates its checksum.
+func setLSN(buf []byte, lsn uint64) {
+	size := len(buf)
+	binary.BigEndian.PutUint64(buf[4:], lsn)
+	binary.BigEndian.PutUint32(buf[size-checksumSize:], crc32.Checksum(buf[:size-checksumSize], crc32c))
+}
+
+// deserialize reads one WAL record from r, reassembling it across pages.
+// It returns io.EOF only when r is exhausted at a record boundary.
+func deserialize(r io.Reader) (*walRecord, error) {
+	buf, err := readRecord(r, maxRecordSize)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecord(buf)
+}
+
+// readRecord reads the raw bytes of one record not larger than limit.
+func readRecord(r io.Reader, limit int64) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size < recordHeaderSize+checksumSize || size > maxRecordSize {
+		return nil, errBrokenRecord
+	}
+	if int64(size) > limit {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	buf := make([]byte, size)
+	copy(buf, header)
+	if _, err := io.ReadFull(r, buf[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// decodeRecord verifies the checksum of a raw record and decodes it.
+func decodeRecord(buf []byte) (*walRecord, error) {
+	size := len(buf)
+	if binary.BigEndian.Uint32(buf[size-checksumSize:]) != crc32.Checksum(buf[:size-checksumSize], crc32c) {
+		return nil, errChecksum
+	}
+	return parseRecord(buf)
+}
+
+// parseRecord decodes a raw record without verifying its checksum.
+func parseRecord(buf []byte) (*walRecord, error) {
+	size := len(buf)
+	body := buf[recordHeaderSize : size-checksumSize]
+
+	rec := &walRecord{
+		lsn: binary.BigEndian.Uint64(buf[4:]),
+		typ: buf[12],
+	}
+	switch rec.typ {
+	case recBegin:
+		if len(body) != 12 {
+			return nil, errBrokenRecord
+		}
+		rec.ts = binary.BigEndian.Uint64(body[0:])
+		rec.opCount = binary.BigEndian.Uint32(body[8:])
+	case recOperation:
+		if len(body) < 5 {
+			return nil, errBrokenRecord
+		}
+		keySize := binary.BigEndian.Uint32(body[1:])
+		if keySize > uint32(len(body)-5) {
+			return nil, errBrokenRecord
+		}
+		rec.op = &Operation{
+			cmd: body[0],
+			version: &Version{
+				key:   string(body[5 : 5+keySize]),
+				value: string(body[5+keySize:]),
+				wTs:   0,
+				rTs:   0,
+				prev:  nil,
+			},
+		}
+	case recCommit:
+		if len(body) != 8 {
+			return nil, errBrokenRecord
+		}
+		rec.ts = binary.BigEndian.Uint64(body[0:])
+	default:
+		return nil, errBrokenRecord
+	}
+
+	return rec, nil
+}
+
+// walFormat is how the records of a segment are stored, as written in its
+// header.
+type walFormat struct {
+	key   *cipherKey // nil if not encrypted
+	codec Compression
+}
+
+// pack compresses (if large) and encrypts an encoded record whose lsn is set.
+func (f walFormat) pack(buf []byte) []byte {
+	return f.seal(f.codec.compressRecord(buf))
+}
+
+// seal encrypts a (compressed) record whose lsn is set, if f has a key.
+func (f walFormat) seal(buf []byte) []byte {
+	if f.key == nil {
+		return buf
+	}
+	return f.key.sealRecord(buf)
+}
+
+// unpack verifies a record packed by pack and returns it decrypted and
+// decompressed.
+func (f walFormat) unpack(buf []byte) ([]byte, error) {
+	size := len(buf)
+	if binary.BigEndian.Uint32(buf[size-checksumSize:]) != crc32.Checksum(buf[:size-checksumSize], crc32c) {
+		return nil, errChecksum
+	}
+	if f.key != nil {
+		var err error
+		if buf, err = f.key.openRecord(buf); err != nil {
+			return nil, err
+		}
+	}
+	return f.codec.decompressRecord(buf)
+}
+
+// walReader reads the records of a WAL file and remembers where each one
+// starts, so that it can resynchronize after a corrupted record.
+type walReader struct {
+	file   io.ReadSeeker
+	format walFormat
+	reader *bufio.Reader
+	offset int64 // start of the next record
+	size   int64 // file size
+}
+
+// newWALReader reads records stored in format from the current position of
+// file.
+func newWALReader(file io.ReadSeeker, format walFormat) (*walReader, error) {
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &walReader{
+		file:   file,
+		format: format,
+		reader: bufio.NewReaderSize(file, WALPageSize),
+		offset: offset,
+		size:   size,
+	}, nil
+}
+
+// next returns the next record. A record whose checksum does not match is
+// skipped as a whole and reported as errChecksum.
+func (r *walReader) next() (*walRecord, error) {
+	buf, err := r.nextRaw()
+	if err != nil {
+		return nil, err
+	}
+	return r.decode(buf)
+}
+
+// decode verifies and decodes a record returned by nextRaw.
+func (r *walReader) decode(buf []byte) (*walRecord, error) {
+	plain, err := r.format.unpack(buf)
+	if err != nil {
+		return nil, err
+	}
+	return parseRecord(plain)
+}
+
+// nextRaw returns the bytes of the next record without verifying them.
+func (r *walReader) nextRaw() ([]byte, error) {
+	buf, err := readRecord(r.reader, r.size-r.offset)
+	if err != nil {
+		return nil, err
+	}
+	r.offset += int64(len(buf))
+	return buf, nil
+}
+
+// resync skips the bytes after the last good record until a valid record
+// begins. It returns io.EOF when no valid record is left.
+func (r *walReader) resync(from int64) error {
+	for offset := from + 1; offset < r.size; offset++ {
+		if _, err := r.file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		r.reader.Reset(r.file)
+		buf, err := readRecord(r.reader, r.size-offset)
+		if err != nil {
+			continue
+		}
+		if _, err := r.decode(buf); err != nil {
+			continue
+		}
+
+		// 見つかった record から読み直す
+		if _, err := r.file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		r.reader.Reset(r.file)
+		r.offset = offset
+		return nil
+	}
+	r.offset = r.size
+	return io.EOF
+}
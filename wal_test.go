@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSerialize(t *testing.T) {
+	recs := []*walRecord{
+		{typ: recBegin, ts: 1, opCount: 4},
+		{typ: recOperation, op: &Operation{INSERT, &Version{"key1", "value1", 0, 0, nil, false}}},
+		{typ: recOperation, op: &Operation{UPDATE, &Version{"key2", strings.Repeat("v", 3*WALPageSize), 0, 0, nil, false}}},
+		{typ: recOperation, op: &Operation{INSERT, &Version{strings.Repeat("k", 300), strings.Repeat("w", 300), 0, 0, nil, false}}},
+		{typ: recOperation, op: &Operation{DELETE, &Version{"key1", "", 0, 0, nil, true}}},
+		{typ: recCommit, ts: 1},
+	}
+
+	buf := new(bytes.Buffer)
+	writer := bufio.NewWriterSize(buf, WALPageSize)
+	for _, rec := range recs {
+		if err := serialize(writer, rec); err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReaderSize(buf, WALPageSize)
+	for _, want := range recs {
+		rec, err := deserialize(reader)
+		if err != nil {
+			t.Fatalf("failed to deserialize: %v", err)
+		}
+		if rec.typ != want.typ || rec.ts != want.ts || rec.opCount != want.opCount {
+			t.Errorf("wrong record: type = %v, ts = %v, op count = %v", rec.typ, rec.ts, rec.opCount)
+		}
+		if want.op == nil {
+			continue
+		}
+		if rec.op.cmd != want.op.cmd || rec.op.version.key != want.op.version.key || rec.op.version.value != want.op.version.value {
+			t.Errorf("wrong operation: cmd = %v, key size = %v, value size = %v", rec.op.cmd, len(rec.op.version.key), len(rec.op.version.value))
+		}
+	}
+	if _, err := deserialize(reader); err != io.EOF {
+		t.Errorf("should be EOF: %v", err)
+	}
+}
+
+func TestDeserialize_TornRecord(t *testing.T) {
+	buf := new(bytes.Buffer)
+	op := &Operation{INSERT, &Version{"key1", strings.Repeat("v", WALPageSize), 0, 0, nil, false}}
+	if err := serialize(buf, &walRecord{typ: recOperation, op: op}); err != nil {
+		t.Fatal(err)
+	}
+	torn := bytes.NewReader(buf.Bytes()[:WALPageSize])
+	if _, err := deserialize(torn); err != io.ErrUnexpectedEOF {
+		t.Errorf("should be unexpected EOF: %v", err)
+	}
+}
+
+// testWalWriter writes committed txs with consecutive lsns
+type testWalWriter struct {
+	w   io.Writer
+	lsn uint64
+}
+
+func (tw *testWalWriter) writeTx(ts uint64, operations ...*Operation) {
+	recs := []*walRecord{{typ: recBegin, ts: ts, opCount: uint32(len(operations))}}
+	for _, op := range operations {
+		recs = append(recs, &walRecord{typ: recOperation, op: op})
+	}
+	recs = append(recs, &walRecord{typ: recCommit, ts: ts})
+	for _, rec := range recs {
+		tw.lsn++
+		rec.lsn = tw.lsn
+		if err := serialize(tw.w, rec); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// writeTestWal writes the test wal in dir as one segment containing buf
+func writeTestWal(dir string, buf []byte) {
+	if err := ioutil.WriteFile(segmentPath(filepath.Join(dir, TestWALFileName), 1), append(segmentHeader(), buf...), 0666); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// record status
+const (
+	statusOK       = "ok"
+	statusChecksum = "checksum mismatch"
+	statusBroken   = "broken"
+	statusTorn     = "torn"
+)
+
+// walDumpEntry is one record (or one unreadable range) of the wal.
+type walDumpEntry struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size"`
+	LSN     uint64 `json:"lsn"`
+	Type    string `json:"type,omitempty"` // empty if the record is unreadable
+	Ts      uint64 `json:"ts"`             // ts of the tx
+	OpCount uint32 `json:"op_count,omitempty"`
+	Op      string `json:"op,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Status  string `json:"status"`
+}
+
+func (e *walDumpEntry) String() string {
+	s := fmt.Sprintf("%v:%v lsn=%v", filepath.Base(e.Segment), e.Offset, e.LSN)
+	switch e.Type {
+	case "begin":
+		s += fmt.Sprintf(" begin ts=%v ops=%v", e.Ts, e.OpCount)
+	case "operation":
+		s += fmt.Sprintf(" %v ts=%v key=%q", e.Op, e.Ts, e.Key)
+		if e.Op != "DELETE" {
+			s += fmt.Sprintf(" value=%q", e.Value)
+		}
+	case "commit":
+		s += fmt.Sprintf(" commit ts=%v", e.Ts)
+	default:
+		s += fmt.Sprintf(" (%v bytes)", e.Size)
+	}
+	if e.Status != statusOK {
+		s += " [" + e.Status + "]"
+	}
+	return s
+}
+
+// walDumpFilter selects the records to dump. Unreadable ranges always match.
+type walDumpFilter struct {
+	key    string
+	fromTs uint64
+	toTs   uint64 // 0 means no limit
+}
+
+func (f *walDumpFilter) match(e *walDumpEntry) bool {
+	if e.Type == "" {
+		return true
+	}
+	if f.key != "" && (e.Type != "operation" || e.Key != f.key) {
+		return false
+	}
+	if e.Ts < f.fromTs || f.toTs > 0 && e.Ts > f.toTs {
+		return false
+	}
+	return true
+}
+
+func opName(cmd uint8) string {
+	switch cmd {
+	case INSERT:
+		return "INSERT"
+	case UPDATE:
+		return "UPDATE"
+	case DELETE:
+		return "DELETE"
+	}
+	return fmt.Sprintf("UNKNOWN(%v)", cmd)
+}
+
+func recordTypeName(typ uint8) string {
+	switch typ {
+	case recBegin:
+		return "begin"
+	case recOperation:
+		return "operation"
+	case recCommit:
+		return "commit"
+	}
+	return ""
+}
+
+// dumpSegment calls fn for every record of a segment, including the ones
+// whose checksum does not match.
+func dumpSegment(fs FileSystem, path string, keys *Keyring, fn func(e *walDumpEntry)) error {
+	file, format, err := openSegment(fs, path, keys)
+	if err == errBrokenSegment {
+		fn(&walDumpEntry{Segment: path, Status: statusBroken})
+		return nil
+	}
+	if err == errTornSegment {
+		fn(&walDumpEntry{Segment: path, Status: statusTorn})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := newWALReader(file, format)
+	if err != nil {
+		return err
+	}
+
+	var ts uint64 // ts of the current tx
+	for {
+		offset := reader.offset
+		buf, err := reader.nextRaw()
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			fn(&walDumpEntry{Segment: path, Offset: offset, Size: reader.size - offset, Status: statusTorn})
+			return nil
+		}
+		if err == errBrokenRecord {
+			// 次の record まで飛ばす
+			if err := reader.resync(offset); err != nil && err != io.EOF {
+				return err
+			}
+			fn(&walDumpEntry{Segment: path, Offset: offset, Size: reader.offset - offset, Status: statusBroken})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		entry := &walDumpEntry{Segment: path, Offset: offset, Size: int64(len(buf)), Status: statusOK}
+		rec, err := reader.decode(buf)
+		if err == errChecksum {
+			entry.Status = statusChecksum
+			// header は暗号化も圧縮もされていない
+			entry.LSN = binary.BigEndian.Uint64(buf[4:])
+			if format.key != nil { // 暗号化されていれば中身は読めない
+				fn(entry)
+				continue
+			}
+			// 圧縮されていれば展開してから読む (壊れて展開できなければ lsn だけ)
+			plain, derr := format.codec.decompressRecord(buf)
+			if derr != nil {
+				fn(entry)
+				continue
+			}
+			rec, err = parseRecord(plain)
+		}
+		if err != nil {
+			entry.Status = statusBroken
+			fn(entry)
+			continue
+		}
+		entry.LSN = rec.lsn
+		entry.Type = recordTypeName(rec.typ)
+		switch rec.typ {
+		case recBegin:
+			ts = rec.ts
+			entry.OpCount = rec.opCount
+		case recOperation:
+			entry.Op = opName(rec.op.cmd)
+			entry.Key = rec.op.version.key
+			entry.Value = rec.op.version.value
+		}
+		if rec.typ == recCommit {
+			entry.Ts = rec.ts
+		} else {
+			entry.Ts = ts
+		}
+		fn(entry)
+	}
+}
+
+// dumpWal writes the records of segments which match filter to w, one per
+// line as text or as JSON.
+func dumpWal(fs FileSystem, w io.Writer, segments []segment, keys *Keyring, filter *walDumpFilter, asJSON bool) error {
+	encoder := json.NewEncoder(w)
+	var werr error
+	for _, seg := range segments {
+		err := dumpSegment(fs, seg.path, keys, func(e *walDumpEntry) {
+			if werr != nil || !filter.match(e) {
+				return
+			}
+			if asJSON {
+				werr = encoder.Encode(e)
+			} else {
+				_, werr = fmt.Fprintln(w, e)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("%v: %w", seg.path, err)
+		}
+		if werr != nil {
+			return werr
+		}
+	}
+	return nil
+}
+
+// waldumpCommand runs `seccampdb waldump`.
+func waldumpCommand(args []string) {
+	flags := flag.NewFlagSet("waldump", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print one JSON object per record")
+	key := flags.String("key", "", "only print the operations on this key")
+	fromTs := flags.Uint64("from-ts", 0, "only print the records of txs whose ts is not smaller")
+	toTs := flags.Uint64("to-ts", 0, "only print the records of txs whose ts is not larger")
+	dataDir := flags.String("data-dir", ".", "directory of the wal")
+	archiveDir := flags.String("archive-dir", "", "also dump the archived wal segments in this directory")
+	keyFiles := addKeyFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: seccampdb waldump [options] [segment file ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	fs := osFS{}
+	walFileName := filepath.Join(*dataDir, WALFileName)
+	var segments []segment
+	var err error
+	if flags.NArg() > 0 {
+		for _, path := range flags.Args() {
+			segments = append(segments, segment{path: path})
+		}
+	} else if *archiveDir != "" {
+		segments, err = restoreSegments(fs, walFileName, *archiveDir)
+	} else {
+		segments, err = listSegments(fs, walFileName)
+	}
+	if err == nil && flags.NArg() == 0 {
+		err = checkDataDir(*dataDir)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys, err := keyFiles.load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	filter := &walDumpFilter{key: *key, fromTs: *fromTs, toTs: *toTs}
+	if err := dumpWal(fs, os.Stdout, segments, keys, filter, *asJSON); err != nil {
+		log.Fatal(err)
+	}
+}
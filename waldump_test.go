@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpWal(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := &testWalWriter{w: buf}
+	tw.writeTx(1, &Operation{INSERT, &Version{"key1", "value 1", 0, 0, nil, false}})
+	tw.writeTx(2, &Operation{UPDATE, &Version{"key1", "value 2", 0, 0, nil, false}}, &Operation{INSERT, &Version{"key2", "value", 0, 0, nil, false}})
+	thirdTx := buf.Len()
+	tw.writeTx(3, &Operation{DELETE, &Version{"key1", "", 0, 0, nil, true}})
+	wal := buf.Bytes()
+	wal[thirdTx+28] ^= 0xff        // tx 3 の begin record の checksum を壊す
+	wal = append(wal, wal[:10]...) // 途中で切れた record
+
+	path := filepath.Join(t.TempDir(), segmentPath("seccampdb.log", 1))
+	if err := ioutil.WriteFile(path, append(segmentHeader(), wal...), 0666); err != nil {
+		t.Fatal(err)
+	}
+	segments := []segment{{path: path, firstLSN: 1}}
+
+	out := new(bytes.Buffer)
+	if err := dumpWal(osFS{}, out, segments, nil, &walDumpFilter{}, true); err != nil {
+		t.Fatal(err)
+	}
+	var entries []walDumpEntry
+	decoder := json.NewDecoder(out)
+	for decoder.More() {
+		var e walDumpEntry
+		if err := decoder.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 11 {
+		t.Fatalf("wrong number of records: %v", len(entries))
+	}
+	if e := entries[4]; e.LSN != 5 || e.Type != "operation" || e.Op != "UPDATE" || e.Ts != 2 || e.Key != "key1" || e.Value != "value 2" || e.Status != statusOK {
+		t.Errorf("wrong record: %+v", e)
+	}
+	if e := entries[7]; e.LSN != 8 || e.Type != "begin" || e.Status != statusChecksum {
+		t.Errorf("broken record should be decoded: %+v", e)
+	}
+	if e := entries[10]; e.Status != statusTorn {
+		t.Errorf("torn record should be reported: %+v", e)
+	}
+
+	// filter
+	out.Reset()
+	if err := dumpWal(osFS{}, out, segments, nil, &walDumpFilter{key: "key1", fromTs: 2}, false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], `UPDATE ts=2 key="key1" value="value 2"`) || !strings.Contains(lines[2], "[torn]") {
+		t.Errorf("wrong output:\n%v", out)
+	}
+}
+
+func TestDumpWal_CompressedChecksum(t *testing.T) {
+	format := walFormat{codec: FlateCompression}
+	value := strings.Repeat("compressed value ", 100)
+	wal := newSegmentHeader(format)
+	for i, rec := range []*walRecord{
+		{lsn: 1, typ: recBegin, ts: 1, opCount: 2},
+		{lsn: 2, typ: recOperation, op: &Operation{cmd: INSERT, version: &Version{key: "key1", value: value}}},
+		{lsn: 3, typ: recOperation, op: &Operation{cmd: INSERT, version: &Version{key: "key2", value: value}}},
+	} {
+		buf, err := encodeRecord(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = format.pack(buf)
+		switch i {
+		case 1:
+			buf[len(buf)-1] ^= 0xff // checksum を壊す
+		case 2:
+			for j := recordHeaderSize; j < len(buf)-checksumSize; j++ { // 展開できないように壊す
+				buf[j] = 0xff
+			}
+		}
+		wal = append(wal, buf...)
+	}
+	path := filepath.Join(t.TempDir(), segmentPath("seccampdb.log", 1))
+	if err := ioutil.WriteFile(path, wal, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []*walDumpEntry
+	if err := dumpSegment(osFS{}, path, nil, func(e *walDumpEntry) { entries = append(entries, e) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("wrong number of records: %v", len(entries))
+	}
+	if e := entries[1]; e.LSN != 2 || e.Type != "operation" || e.Key != "key1" || e.Value != value || e.Status != statusChecksum {
+		t.Errorf("compressed record with a wrong checksum should be decoded: %+v", e)
+	}
+	if e := entries[2]; e.LSN != 3 || e.Status != statusChecksum {
+		t.Errorf("lsn of an unreadable record should be reported: %+v", e)
+	}
+}